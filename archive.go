@@ -1,13 +1,17 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"math"
 	"os"
 	"path/filepath"
+	"slices"
 	"syscall"
 
 	"golang.org/x/sys/unix"
@@ -15,7 +19,7 @@ import (
 
 var zeroes = make([]byte, cowAlignment)
 
-func (c *car) writeTag(tagType, length uint16, out *os.File, data any) error {
+func (c *car) writeTag(tagType, length uint16, out *archiveWriter, data any) error {
 	t := tag{
 		Tag:    tagType,
 		Length: length,
@@ -33,38 +37,241 @@ func (c *car) writeTag(tagType, length uint16, out *os.File, data any) error {
 	return nil
 }
 
-func (c *car) writeData(out *os.File, e entry) error {
-	if e.size == 0 || e.Mode&unix.S_IFMT != unix.S_IFREG {
-		return c.writeTag(tagData, 0, out, nil)
+// hashFile returns the SHA-256 of the file content, and rewinds it
+func hashFile(in *os.File, size uint64) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+
+	h := sha256.New()
+	_, err := io.CopyN(h, in, int64(size))
+	if err != nil {
+		return sum, err
 	}
+	copy(sum[:], h.Sum(nil))
 
-	pd := paddedData{
-		Size: e.size,
+	_, err = in.Seek(0, io.SeekStart)
+
+	return sum, err
+}
+
+// writeRef writes a reference to data already stored in the archive
+func (c *car) writeRef(out *archiveWriter, e entry, stored storedData) error {
+	if stored.encoding != encodingNone {
+		ed := encodedData{
+			Encoding: stored.encoding,
+			Size:     e.size,
+		}
+		err := c.writeTag(tagEncoding, uint16(binary.Size(ed)), out, &ed)
+		if err != nil {
+			return err
+		}
+	}
+
+	if stored.nonce != nil {
+		err := c.writeTag(tagCipher, noncePrefixSize, out, stored.nonce)
+		if err != nil {
+			return err
+		}
+	}
+
+	ref := dataRef{
+		Offset: stored.offset,
+		Size:   stored.size,
+	}
+	err := c.writeTag(tagDataRef, uint16(binary.Size(ref)), out, &ref)
+	if err != nil {
+		return err
 	}
 
-	// To add padding, we need to know the current offset, so the file must be seekable
-	if offset, err := out.Seek(0, io.SeekCurrent); err == nil {
-		// tag + paddedData
-		const overhead = 4 + 12
-		newDataOffset := round4k(uint64(offset + overhead))
-		padding := newDataOffset - uint64(offset+overhead)
+	return c.writeTag(tagData, 0, out, nil)
+}
 
-		pd.Padding = uint32(padding)
+// writeEncoded writes the file compressed and/or encrypted. The compression is done
+// into a temporary file first, as the stored size must be written before the data
+func (c *car) writeEncoded(out *archiveWriter, in *os.File, e entry, sum [sha256.Size]byte) error {
+	var src io.Reader = in
+	size := e.size
+	encoding := encodingNone
 
-		err = c.writeTag(tagData, 12, out, &pd)
+	if c.compress != encodingNone {
+		tmp, err := os.CreateTemp("", "car")
 		if err != nil {
 			return err
 		}
+		os.Remove(tmp.Name())
+		defer tmp.Close()
 
-		_, err = out.Seek(int64(padding), io.SeekCurrent)
+		enc, err := newEncoder(c.compress, tmp)
 		if err != nil {
 			return err
 		}
-	} else {
-		err = c.writeTag(tagData, 12, out, &pd)
+
+		_, err = io.CopyN(enc, in, int64(e.size))
+		if err != nil {
+			return err
+		}
+
+		err = enc.Close()
+		if err != nil {
+			return err
+		}
+
+		compressed, err := tmp.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+
+		if uint64(compressed) < e.size {
+			_, err = tmp.Seek(0, io.SeekStart)
+			src = tmp
+			size = uint64(compressed)
+			encoding = c.compress
+		} else {
+			// Not worth it, store the file as is
+			_, err = in.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if encoding == encodingNone && c.payloadKey == nil {
+		return c.writePadded(out, in, e, sum)
+	}
+
+	if encoding != encodingNone {
+		ed := encodedData{
+			Encoding: encoding,
+			Size:     e.size,
+		}
+		err := c.writeTag(tagEncoding, uint16(binary.Size(ed)), out, &ed)
+		if err != nil {
+			return err
+		}
+	}
+
+	var nonce []byte
+	stored := size
+	if c.payloadKey != nil {
+		nonce = make([]byte, noncePrefixSize)
+		_, err := rand.Read(nonce)
 		if err != nil {
 			return err
 		}
+
+		err = c.writeTag(tagCipher, noncePrefixSize, out, nonce)
+		if err != nil {
+			return err
+		}
+
+		stored = encryptedSize(size)
+	}
+
+	// Encoded data can't be reflinked, so don't pad it
+	pd := paddedData{
+		Size: stored,
+	}
+	err := c.writeTag(tagData, 12, out, &pd)
+	if err != nil {
+		return err
+	}
+
+	if out.seekable {
+		err = allocate(out.file, out.offset, int64(stored))
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.dedup {
+		c.hashes[sum] = storedData{
+			offset:   uint64(out.offset),
+			size:     stored,
+			encoding: encoding,
+			nonce:    nonce,
+			name:     e.name,
+		}
+	}
+
+	c.countData(methodCopy, e.size)
+
+	if nonce == nil {
+		_, err = io.CopyN(out, src, int64(size))
+		return err
+	}
+
+	cw, err := newChunkWriter(out, c.payloadKey, nonce, e.name)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.CopyN(cw, src, int64(size))
+	if err != nil {
+		return err
+	}
+
+	return cw.Close()
+}
+
+// writePadded writes the file content aligned to the block size, so it can be reflinked
+func (c *car) writePadded(out *archiveWriter, in *os.File, e entry, sum [sha256.Size]byte) error {
+	// tag + paddedData
+	const overhead = 4 + 12
+	newDataOffset := roundUp(uint64(out.offset+overhead), c.alignment)
+	padding := newDataOffset - uint64(out.offset+overhead)
+
+	pd := paddedData{
+		Size:    e.size,
+		Padding: uint32(padding),
+	}
+	c.padded.Add(padding)
+
+	err := c.writeTag(tagData, 12, out, &pd)
+	if err != nil {
+		return err
+	}
+
+	err = out.skip(int64(padding))
+	if err != nil {
+		return err
+	}
+
+	if c.dedup {
+		c.hashes[sum] = storedData{
+			offset: newDataOffset,
+			size:   e.size,
+		}
+	}
+
+	c.method = methodReflink
+	err = reflinkError
+	if !c.noReflink {
+		err = reflinkToArchive(in, out.file, e.size)
+	}
+	if errors.Is(err, reflinkError) {
+		if c.requireReflink {
+			return fmt.Errorf("%s: %w", e.localName, reflinkRequired(err))
+		}
+		if out.seekable {
+			err = allocate(out.file, out.offset, int64(e.size))
+			if err != nil {
+				return err
+			}
+		}
+		c.method, err = copyContent(out.file, in, -1, int64(e.size))
+	}
+	if err != nil {
+		return err
+	}
+
+	out.advance(int64(e.size))
+	c.countData(c.method, e.size)
+
+	return nil
+}
+
+func (c *car) writeData(out *archiveWriter, e entry) error {
+	if e.size == 0 || e.Mode&unix.S_IFMT != unix.S_IFREG {
+		return c.writeTag(tagData, 0, out, nil)
 	}
 
 	in, err := os.Open(e.localName)
@@ -73,17 +280,27 @@ func (c *car) writeData(out *os.File, e entry) error {
 	}
 	defer in.Close()
 
-	err = reflinkToArchive(in, out, e.size)
-	if err != nil && !errors.Is(err, reflinkError) {
-		return err
+	var sum [sha256.Size]byte
+	if c.dedup {
+		sum, err = hashFile(in, e.size)
+		if err != nil {
+			return err
+		}
+
+		// Same content already archived, just point to it
+		if stored, ok := c.hashes[sum]; ok {
+			return c.writeRef(out, e, stored)
+		}
 	}
 
-	_, err = io.Copy(out, in)
+	if c.compress != encodingNone || c.payloadKey != nil {
+		return c.writeEncoded(out, in, e, sum)
+	}
 
-	return err
+	return c.writePadded(out, in, e, sum)
 }
 
-func (c *car) writeHeader(out *os.File, e entry) error {
+func (c *car) writeHeader(out *archiveWriter, e entry) error {
 	_, err := out.Write([]byte(cowMagic))
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "Write error:", err)
@@ -152,11 +369,7 @@ func unixMode(mode fs.FileMode) uint32 {
 	return unixMode | uint32(mode.Perm())
 }
 
-func (c *car) walker(strip int, p string, statinfo fs.FileInfo, err error, outFd *os.File) error {
-	if c.verbose {
-		fmt.Fprintln(c.infoFd, p)
-	}
-
+func (c *car) walker(strip int, p string, statinfo fs.FileInfo, err error, out *archiveWriter) error {
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "Error walking", p, err)
 		return err
@@ -192,6 +405,8 @@ func (c *car) walker(strip int, p string, statinfo fs.FileInfo, err error, outFd
 		entry.dev = uint32(sys.Rdev)
 	}
 
+	c.normalize(&entry.fixedData)
+
 	switch {
 	case info&fs.ModeNamedPipe != 0:
 		break
@@ -210,24 +425,93 @@ func (c *car) walker(strip int, p string, statinfo fs.FileInfo, err error, outFd
 		}
 	}
 
-	err = c.writeHeader(outFd, entry)
+	c.method = ""
+	err = c.writeHeader(out, entry)
 	if err != nil {
 		return err
 	}
 
+	if c.verbose {
+		if c.method != "" {
+			fmt.Fprintf(c.infoFd, "%s (%s)\n", p, c.method)
+		} else {
+			fmt.Fprintln(c.infoFd, p)
+		}
+	}
+
+	c.entryDone(entry.size)
+
+	return nil
+}
+
+// normalize applies the --owner, --group and --mtime overrides to an entry
+func (c *car) normalize(fd *fixedData) {
+	if c.forceUid {
+		fd.Uid = c.uid
+	}
+	if c.forceGid {
+		fd.Gid = c.gid
+	}
+	if c.setMtime && (!c.clampMtime || fd.Mtime > c.mtime) {
+		fd.Mtime = c.mtime
+	}
+}
+
+// setDeterministic fills the options not given explicitly with fixed values,
+// so that the same tree always produces the same archive
+func (c *car) setDeterministic() error {
+	c.sortNames = true
+
+	if !c.forceUid {
+		c.forceUid = true
+		c.uid = 0
+	}
+	if !c.forceGid {
+		c.forceGid = true
+		c.gid = 0
+	}
+
+	if !c.setMtime {
+		c.setMtime = true
+		c.mtime = 0
+		if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+			mtime, err := parseTime("@" + epoch)
+			if err != nil {
+				return fmt.Errorf("invalid SOURCE_DATE_EPOCH: %w", err)
+			}
+			c.mtime = mtime
+			c.clampMtime = true
+		}
+	}
+
 	return nil
 }
 
-func (c *car) walkPaths(paths []string, outFd *os.File) error {
+func (c *car) walkPaths(paths []string, out *archiveWriter) error {
+	if c.sortNames {
+		paths = slices.Clone(paths)
+		for i := range paths {
+			paths[i] = filepath.Clean(paths[i])
+		}
+		slices.Sort(paths)
+	}
+
 	for _, dir := range paths {
 		dir = filepath.Clean(dir)
-		err := filepath.Walk(dir, func(p string, i fs.FileInfo, err error) error {
+		walkFn := func(p string, i fs.FileInfo, err error) error {
 			topdir := filepath.Dir(dir)
 			if topdir == "." {
 				topdir = ""
 			}
-			return c.walker(len(topdir), p, i, err, outFd)
-		})
+			return c.walker(len(topdir), p, i, err, out)
+		}
+
+		var err error
+		if c.jobs > 1 {
+			err = c.walkParallel(dir, walkFn)
+		} else {
+			err = filepath.Walk(dir, walkFn)
+		}
 		if err != nil {
 			return err
 		}
@@ -236,11 +520,81 @@ func (c *car) walkPaths(paths []string, outFd *os.File) error {
 	return nil
 }
 
+// writeArchiveHeader writes a record without name, with the format version and, when encrypting,
+// the file key wrapped for every recipient
+func (c *car) writeArchiveHeader(out *archiveWriter) error {
+	fd := formatData{
+		Version: formatVersion,
+	}
+	if c.dedup {
+		fd.Features |= featureDedup
+	}
+	if c.compress != encodingNone {
+		fd.Features |= featureCompression
+	}
+	if c.encrypt {
+		fd.Features |= featureEncryption
+	}
+	if c.signKey != nil {
+		fd.Features |= featureSignature
+	}
+	if c.alignment != cowAlignment {
+		fd.Features |= featureAlignment
+	}
+
+	var header []byte
+	if c.encrypt {
+		if len(c.recipients) == 0 && c.passphrase == nil {
+			return errors.New("encryption needs a recipient or a passphrase")
+		}
+
+		var err error
+		header, err = c.encryptionHeader()
+		if err != nil {
+			return err
+		}
+		if len(header) > math.MaxUint16 {
+			return errors.New("too many recipients")
+		}
+	}
+
+	_, err := out.Write([]byte(cowMagic))
+	if err != nil {
+		return err
+	}
+
+	err = c.writeTag(tagFormat, uint16(binary.Size(fd)), out, &fd)
+	if err != nil {
+		return err
+	}
+
+	err = c.writeTag(tagAlignment, 4, out, uint32(c.alignment))
+	if err != nil {
+		return err
+	}
+
+	if header != nil {
+		err = c.writeTag(tagEncryption, uint16(len(header)), out, header)
+		if err != nil {
+			return err
+		}
+	}
+
+	return c.writeTag(tagData, 0, out, nil)
+}
+
 func (c *car) archive(paths []string, outFile string) error {
 	var err error
 	outFd := os.Stdout
 	c.infoFd = os.Stderr
 
+	if c.deterministic {
+		err = c.setDeterministic()
+		if err != nil {
+			return err
+		}
+	}
+
 	if outFile != "" {
 		outFd, err = os.Create(outFile)
 		if err != nil {
@@ -252,33 +606,93 @@ func (c *car) archive(paths []string, outFile string) error {
 		c.infoFd = os.Stdout
 	}
 
-	_, err = outFd.Seek(0, io.SeekCurrent)
-	if err == nil {
-		c.seekable = true
-	} else {
-		fmt.Fprintln(os.Stderr, "Warning: archive is not seekable, padding will be disabled")
+	// The archive is compressed as a whole by writing it into a pipe
+	var compressed <-chan error
+	if c.streamCompress != encodingNone {
+		outFd, compressed, err = writePipe(c.streamCompress, outFd)
+		if err != nil {
+			return err
+		}
+		defer outFd.Close()
+	}
+
+	out := newArchiveWriter(outFd)
+	start := out.offset
+	c.seekable = out.seekable
+	if !c.seekable {
+		if c.signKey != nil {
+			return errors.New("signing needs a seekable archive")
+		}
+		if c.dedup {
+			fmt.Fprintln(os.Stderr, "Warning: deduplication needs a seekable archive, disabling it")
+			c.dedup = false
+		}
+	}
+
+	if c.dedup {
+		c.hashes = make(map[[sha256.Size]byte]storedData)
+	}
+
+	if c.requireReflink {
+		switch {
+		case !c.seekable || compressed != nil:
+			return errors.New("reflink needs a seekable, uncompressed archive")
+		case c.compress != encodingNone || c.encrypt:
+			return errors.New("compressed or encrypted data can't be reflinked")
+		}
 	}
 
-	err = c.walkPaths(paths, outFd)
+	/* reflink needs the data aligned to the block size of the filesystem, but reproducible
+	 * archives must not depend on where they are written, so they use the default one */
+	c.alignment = cowAlignment
+	if c.compact {
+		// Unaligned data can't be reflinked
+		c.alignment = 1
+		c.noReflink = true
+	} else if c.seekable && !c.deterministic {
+		c.alignment = fsBlockSize(outFd)
+	}
+
+	err = c.writeArchiveHeader(out)
 	if err != nil {
 		return err
 	}
 
-	_, err = outFd.Write([]byte(cowEnd))
+	if c.progress.show {
+		c.startProgress(scanPaths(paths))
+	}
+
+	err = c.walkPaths(paths, out)
 	if err != nil {
 		return err
 	}
 
-	if c.seekable {
-		offset, err := outFd.Seek(0, io.SeekEnd)
+	if c.signKey != nil {
+		err = c.writeSignature(out, start)
 		if err != nil {
 			return err
 		}
-		err = outFd.Truncate(int64(round4k(uint64(offset))))
+	}
+
+	_, err = out.Write([]byte(cowEnd))
+	if err != nil {
+		return err
+	}
+
+	// Pad the end, so that the last entries can be reflinked
+	end := roundUp(uint64(out.offset), c.alignment)
+	c.padded.Add(end - uint64(out.offset))
+	if fi, serr := outFd.Stat(); serr == nil && fi.Mode().IsRegular() {
+		err = outFd.Truncate(int64(end))
 	} else {
-		// As we don't know the cursor position, write the maximum alignment
-		buf := make([]byte, cowAlignment)
-		_, err = outFd.Write(buf)
+		err = out.skip(int64(end) - out.offset)
+	}
+
+	if compressed != nil {
+		outFd.Close()
+		if cerr := <-compressed; err == nil {
+			err = cerr
+		}
 	}
 
 	return err
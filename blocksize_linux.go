@@ -0,0 +1,18 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// blockSize returns the block size of the filesystem containing the file, which reflink needs the data aligned to
+func blockSize(f *os.File) uint64 {
+	var st unix.Statfs_t
+	if unix.Fstatfs(int(f.Fd()), &st) != nil {
+		return cowAlignment
+	}
+	return validAlignment(uint64(st.Bsize))
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// blockSize returns the preferred I/O size of the file, as the block size of the filesystem
+func blockSize(f *os.File) uint64 {
+	var st unix.Stat_t
+	if unix.Fstat(int(f.Fd()), &st) != nil {
+		return cowAlignment
+	}
+	return validAlignment(uint64(st.Blksize))
+}
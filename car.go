@@ -1,9 +1,15 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func b(b bool) int {
@@ -13,6 +19,184 @@ func b(b bool) int {
 	return 0
 }
 
+// parseTime parses a time as @EPOCH, RFC 3339 or a plain date, and returns it in nanoseconds
+func parseTime(s string) (int64, error) {
+	if strings.HasPrefix(s, "@") {
+		secs, err := strconv.ParseInt(s[1:], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		return secs * 1e9, nil
+	}
+
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UnixNano(), nil
+		}
+	}
+
+	return 0, errors.New("invalid time: " + s)
+}
+
+// lookupId resolves a user or group name, or a numeric ID
+func lookupId(name string, lookup func(string) (string, error)) (uint32, error) {
+	if id, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return uint32(id), nil
+	}
+
+	id, err := lookup(name)
+	if err != nil {
+		return 0, err
+	}
+
+	uid, err := strconv.ParseUint(id, 10, 32)
+	return uint32(uid), err
+}
+
+func lookupUser(name string) (string, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return "", err
+	}
+	return u.Uid, nil
+}
+
+func lookupGroup(name string) (string, error) {
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return "", err
+	}
+	return g.Gid, nil
+}
+
+// encodingFlag is a flag which can be given alone or with a value, like --compress or --compress=gzip
+type encodingFlag struct {
+	set      bool
+	encoding uint16
+}
+
+func (f *encodingFlag) String() string {
+	if f == nil || !f.set {
+		return ""
+	}
+	return encodingNames[f.encoding]
+}
+
+func (f *encodingFlag) Set(s string) error {
+	var err error
+
+	switch s {
+	case "true":
+		f.encoding = encodingZstd
+	case "false":
+		f.encoding = encodingNone
+	default:
+		f.encoding, err = parseEncoding(s)
+	}
+	f.set = true
+
+	return err
+}
+
+func (f *encodingFlag) IsBoolFlag() bool {
+	return true
+}
+
+// backupFlag is --backup, or --backup=CONTROL to choose the kind of backup
+type backupFlag int
+
+func (f *backupFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	switch *f {
+	case backupSimple:
+		return "simple"
+	case backupNumbered:
+		return "numbered"
+	}
+	return ""
+}
+
+func (f *backupFlag) Set(s string) error {
+	switch s {
+	case "true", "simple", "never":
+		*f = backupSimple
+	case "false", "none", "off":
+		*f = backupNone
+	case "numbered", "t":
+		*f = backupNumbered
+	default:
+		return errors.New("invalid backup control: " + s)
+	}
+	return nil
+}
+
+func (f *backupFlag) IsBoolFlag() bool {
+	return true
+}
+
+// spoolFlag is --spool, or --spool=FILE to keep the spooled archive
+type spoolFlag struct {
+	set  bool
+	file string
+}
+
+func (f *spoolFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.file
+}
+
+func (f *spoolFlag) Set(s string) error {
+	switch s {
+	case "true":
+		f.set, f.file = true, ""
+	case "false":
+		f.set, f.file = false, ""
+	default:
+		f.set, f.file = true, s
+	}
+	return nil
+}
+
+func (f *spoolFlag) IsBoolFlag() bool {
+	return true
+}
+
+// stringList is a flag which can be repeated
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// readPassphrase reads the passphrase from a file, or from the CAR_PASSPHRASE variable
+func readPassphrase(file string) ([]byte, error) {
+	if file == "" {
+		if pass, ok := os.LookupEnv("CAR_PASSPHRASE"); ok {
+			return []byte(pass), nil
+		}
+		return nil, errors.New("CAR_PASSPHRASE is not set")
+	}
+
+	pass, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimRight(pass, "\r\n"), nil
+}
+
 func main() {
 	var err error
 
@@ -21,18 +205,214 @@ func main() {
 	x := flag.Bool("x", false, "extract")
 	file := flag.String("f", "", "file")
 	verbose := flag.Bool("v", false, "verbose")
+	sort := flag.String("sort", "none", "sort the path arguments: none or name")
+	mtime := flag.String("mtime", "", "set the modification time of the entries, as @EPOCH or date")
+	clampMtime := flag.Bool("clamp-mtime", false, "only set the time of entries newer than --mtime")
+	owner := flag.String("owner", "", "force NAME or ID as owner of the entries")
+	group := flag.String("group", "", "force NAME or ID as group of the entries")
+	deterministic := flag.Bool("deterministic", false, "create a reproducible archive")
+	dedup := flag.Bool("dedup", false, "store identical file contents only once")
+	var compress encodingFlag
+	flag.Var(&compress, "compress", "compress the file contents: zstd (default), gzip, xz or none")
+	gzip := flag.Bool("z", false, "compress the archive with gzip")
+	zstd := flag.Bool("zstd", false, "compress the archive with zstd")
+	xz := flag.Bool("J", false, "compress the archive with xz")
+	encrypt := flag.Bool("encrypt", false, "encrypt the file contents")
+	var recipients, identities stringList
+	flag.Var(&recipients, "recipient", "encrypt for the public key `age1...`, can be repeated")
+	flag.Var(&identities, "identity", "decrypt with the secret keys in `FILE`, can be repeated")
+	usePass := flag.Bool("passphrase", false, "encrypt or decrypt with the passphrase in $CAR_PASSPHRASE")
+	passFile := flag.String("passphrase-file", "", "read the passphrase from `FILE` instead of $CAR_PASSPHRASE")
+	keys := flag.Bool("keygen", false, "generate a new key pair")
+	sign := flag.String("sign", "", "sign the archive with the Ed25519 private key in `FILE`")
+	verify := flag.String("verify-signature", "", "verify the archive signature with the Ed25519 public key in `FILE`")
+	keepOld := flag.Bool("keep-old-files", false, "don't replace existing files, and report them as errors")
+	skipOld := flag.Bool("skip-old-files", false, "don't replace existing files, silently")
+	keepNewer := flag.Bool("keep-newer-files", false, "don't replace existing files newer than the archived ones")
+	unlinkFirst := flag.Bool("unlink-first", false, "remove existing files before extracting them")
+	recursiveUnlink := flag.Bool("recursive-unlink", false, "remove whole directories in the way of other files")
+	var backup backupFlag
+	flag.Var(&backup, "backup", "rename the replaced files to NAME~, or NAME.~N~ with --backup=numbered")
+	dedupeExisting := flag.Bool("dedupe-existing", false, "keep the existing files with the same content, sharing their data with the archive")
+	dryRun := flag.Bool("dry-run", false, "only print what extraction would create, replace or skip")
+	jobs := flag.Int("j", 1, "read up to `N` files in parallel while archiving, or write them while extracting")
+	salvage := flag.Bool("recover", false, "skip the damaged parts of the archive while listing or extracting")
+	var spool spoolFlag
+	flag.Var(&spool, "spool", "save a streamed archive into a file on the destination filesystem and reflink the data from it, --spool=FILE keeps it")
+	showProgress := flag.Bool("progress", false, "print the entries and bytes done, the throughput and the ETA")
+	checkpoint := flag.Uint64("checkpoint", 0, "run the checkpoint actions every `N` entries")
+	var checkpointActions stringList
+	flag.Var(&checkpointActions, "checkpoint-action", "at every checkpoint, echo, print a dot or exec=`CMD`, can be repeated")
+	totals := flag.Bool("totals", false, "print the bytes reflinked, copied and used for padding")
+	requireReflink := flag.Bool("require-reflink", false, "fail instead of copying the data which can't be reflinked")
+	noReflink := flag.Bool("no-reflink", false, "always copy the data, so that the archive or the files don't share it")
+	compact := flag.Bool("compact", false, "don't align the data, for archives which won't be reflinked")
 	flag.Parse()
 
+	if *keys {
+		err = keygen(os.Stdout)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	if b(*t)+b(*c)+b(*x) != 1 {
 		fmt.Fprintln(os.Stderr, "Exactly one ption -t, -c or -x must be specified")
 		os.Exit(1)
 	}
 
-	var a archive = &car{
-		verbose: *verbose,
-		list:    *t,
+	if b(*gzip)+b(*zstd)+b(*xz) > 1 {
+		fmt.Fprintln(os.Stderr, "Only one of -z, --zstd or -J can be specified")
+		os.Exit(1)
+	}
+
+	if b(*keepOld)+b(*skipOld)+b(*keepNewer) > 1 {
+		fmt.Fprintln(os.Stderr, "Only one of --keep-old-files, --skip-old-files or --keep-newer-files can be specified")
+		os.Exit(1)
+	}
+
+	if *requireReflink && (*noReflink || *compact) {
+		fmt.Fprintln(os.Stderr, "--require-reflink can't be used with --no-reflink or --compact")
+		os.Exit(1)
 	}
 
+	cr := &car{
+		verbose:         *verbose,
+		list:            *t,
+		deterministic:   *deterministic,
+		clampMtime:      *clampMtime,
+		dedup:           *dedup,
+		compress:        compress.encoding,
+		recover:         *salvage,
+		unlinkFirst:     *unlinkFirst,
+		recursiveUnlink: *recursiveUnlink,
+		backup:          int(backup),
+		dedupeExisting:  *dedupeExisting,
+		dryRun:          *dryRun,
+		jobs:            *jobs,
+		requireReflink:  *requireReflink,
+		noReflink:       *noReflink,
+		compact:         *compact,
+		spool:           spool.set,
+		spoolFile:       spool.file,
+		checkpoint:      *checkpoint,
+	}
+	cr.progress.show = *showProgress
+
+	for _, action := range checkpointActions {
+		if !validCheckpointAction(action) {
+			fmt.Fprintln(os.Stderr, "Invalid checkpoint action:", action)
+			os.Exit(1)
+		}
+	}
+	cr.checkpointActions = checkpointActions
+
+	switch {
+	case *keepOld:
+		cr.overwrite = overwriteKeepOld
+	case *skipOld:
+		cr.overwrite = overwriteSkipOld
+	case *keepNewer:
+		cr.overwrite = overwriteKeepNewer
+	}
+
+	switch *sort {
+	case "none":
+	case "name":
+		cr.sortNames = true
+	default:
+		fmt.Fprintln(os.Stderr, "Invalid sort order:", *sort)
+		os.Exit(1)
+	}
+
+	if *mtime != "" {
+		cr.mtime, err = parseTime(*mtime)
+		cr.setMtime = true
+	} else if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" && *clampMtime {
+		cr.mtime, err = parseTime("@" + epoch)
+		cr.setMtime = true
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid --mtime:", err)
+		os.Exit(1)
+	}
+
+	if *owner != "" {
+		cr.uid, err = lookupId(*owner, lookupUser)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid --owner:", err)
+			os.Exit(1)
+		}
+		cr.forceUid = true
+	}
+
+	if *group != "" {
+		cr.gid, err = lookupId(*group, lookupGroup)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid --group:", err)
+			os.Exit(1)
+		}
+		cr.forceGid = true
+	}
+
+	switch {
+	case *gzip:
+		cr.streamCompress = encodingGzip
+	case *zstd:
+		cr.streamCompress = encodingZstd
+	case *xz:
+		cr.streamCompress = encodingXz
+	}
+
+	// Without recipients, the encryption can only be done with a passphrase
+	if *usePass || *passFile != "" || (*encrypt && len(recipients) == 0) {
+		cr.passphrase, err = readPassphrase(*passFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Can't read the passphrase:", err)
+			os.Exit(1)
+		}
+	}
+
+	for _, r := range recipients {
+		key, err := parseRecipient(r)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid recipient", r+":", err)
+			os.Exit(1)
+		}
+		cr.recipients = append(cr.recipients, key)
+	}
+
+	for _, file := range identities {
+		keys, err := readIdentities(file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid identity:", err)
+			os.Exit(1)
+		}
+		cr.identities = append(cr.identities, keys...)
+	}
+
+	cr.encrypt = *encrypt || len(recipients) > 0
+
+	if *sign != "" {
+		cr.signKey, err = loadSigningKey(*sign)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid signing key:", err)
+			os.Exit(1)
+		}
+	}
+
+	if *verify != "" {
+		cr.verifyKey, err = loadVerifyKey(*verify)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid verification key:", err)
+			os.Exit(1)
+		}
+	}
+
+	var a archive = cr
+
 	switch {
 	case *c:
 		if flag.NArg() == 0 {
@@ -43,11 +423,29 @@ func main() {
 		err = a.archive(flag.Args(), *file)
 
 	case *t, *x:
+		// --spool takes its optional value only after an equal sign
+		if flag.NArg() > 0 {
+			fmt.Fprintln(os.Stderr, "Unexpected argument:", flag.Arg(0))
+			if spool.set {
+				fmt.Fprintln(os.Stderr, "To keep the spool use --spool="+flag.Arg(0))
+			}
+			os.Exit(1)
+		}
+
 		err = a.extract(*file)
 	}
 
+	if *showProgress {
+		cr.printProgress(true)
+	}
+
+	if *totals && !*t {
+		cr.printTotals()
+	}
+
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
 	os.Exit(a.(*car).error)
 }
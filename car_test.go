@@ -2,10 +2,20 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"fmt"
 	"io"
 	"io/fs"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
 )
 
 var testDir string
@@ -89,7 +99,7 @@ func copyFile(src, dst string) error {
 	return err
 }
 
-func testSetup(t *testing.T) error {
+func testSetup(t testing.TB) error {
 	var err error
 
 	testDir = t.TempDir()
@@ -154,3 +164,1910 @@ func TestCar(t *testing.T) {
 		t.Run("Extract", testExtract)
 	}
 }
+
+func createDeterministic(t *testing.T, name string, paths ...string) []byte {
+	c := car{
+		deterministic: true,
+	}
+
+	err := c.archive(paths, testDir+"/"+name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(testDir + "/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func TestReproducible(t *testing.T) {
+	err := testSetup(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := createDeterministic(t, "first.car", testDir+"/create/dir2", testDir+"/create/dir1")
+
+	later := time.Now().Add(time.Hour)
+	err = filepath.Walk(testDir+"/create", func(p string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if os.Getuid() == 0 {
+			if err := os.Lchown(p, 1234, 1234); err != nil {
+				return err
+			}
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return nil
+		}
+		return os.Chtimes(p, later, later)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// On a filesystem with another block size
+	fsBlockSize = func(*os.File) uint64 { return maxAlignment }
+	defer func() { fsBlockSize = blockSize }()
+
+	second := createDeterministic(t, "second.car", testDir+"/create/dir1", testDir+"/create/dir2/")
+
+	if !bytes.Equal(first, second) {
+		t.Fatal("archives of the same tree differ")
+	}
+}
+
+// extractIn extracts an archive in the given directory
+func extractIn(t *testing.T, c *car, dir, archive string) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.MkdirAll(dir, 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.Chdir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+
+	err = c.extract(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// compareTrees checks that the test entries were extracted with the right content
+func compareTrees(t *testing.T, dir string) {
+	for _, e := range testEntries {
+		if !e.mode.IsRegular() {
+			continue
+		}
+
+		orig, err := os.ReadFile(testDir + "/create/" + e.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		extracted, err := os.ReadFile(dir + "/create/" + e.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(orig, extracted) {
+			t.Errorf("%s: content differs", e.name)
+		}
+	}
+}
+
+func TestDedup(t *testing.T) {
+	err := testSetup(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := car{}
+	err = c.archive([]string{testDir + "/create"}, testDir+"/plain.car")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c = car{dedup: true}
+	err = c.archive([]string{testDir + "/create"}, testDir+"/dedup.car")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plain, err := os.Stat(testDir + "/plain.car")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dedup, err := os.Stat(testDir + "/dedup.car")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if dedup.Size() >= plain.Size() {
+		t.Errorf("deduplicated archive is %d bytes, plain one %d", dedup.Size(), plain.Size())
+	}
+
+	extractIn(t, &car{}, testDir+"/extract", testDir+"/dedup.car")
+	compareTrees(t, testDir+"/extract")
+}
+
+func TestCompress(t *testing.T) {
+	err := testSetup(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"zstd", "gzip"} {
+		t.Run(name, func(t *testing.T) {
+			encoding, err := parseEncoding(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := car{
+				compress: encoding,
+				dedup:    true,
+			}
+			err = c.archive([]string{testDir + "/create"}, testDir+"/"+name+".car")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			extractIn(t, &car{}, testDir+"/"+name, testDir+"/"+name+".car")
+			compareTrees(t, testDir+"/"+name)
+		})
+	}
+
+	for _, name := range []string{"zstd", "gzip", "xz"} {
+		t.Run("stream-"+name, func(t *testing.T) {
+			encoding, err := parseEncoding(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := car{
+				streamCompress: encoding,
+			}
+			err = c.archive([]string{testDir + "/create"}, testDir+"/stream."+name)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			extractIn(t, &car{}, testDir+"/stream-"+name, testDir+"/stream."+name)
+			compareTrees(t, testDir+"/stream-"+name)
+		})
+	}
+}
+
+func TestEncrypt(t *testing.T) {
+	err := testSetup(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var id bytes.Buffer
+	err = keygen(&id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(testDir+"/id.txt", id.Bytes(), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	identities, err := readIdentities(testDir + "/id.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pub := bytes.TrimPrefix(bytes.Split(id.Bytes(), []byte("\n"))[0], []byte("# public key: "))
+	recipient, err := parseRecipient(string(pub))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := car{
+		encrypt:    true,
+		compress:   encodingZstd,
+		dedup:      true,
+		recipients: [][]byte{recipient},
+		passphrase: []byte("secret"),
+	}
+	err = c.archive([]string{testDir + "/create"}, testDir+"/test.car")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Identity", func(t *testing.T) {
+		extractIn(t, &car{identities: identities}, testDir+"/identity", testDir+"/test.car")
+		compareTrees(t, testDir+"/identity")
+	})
+
+	t.Run("Passphrase", func(t *testing.T) {
+		extractIn(t, &car{passphrase: []byte("secret")}, testDir+"/passphrase", testDir+"/test.car")
+		compareTrees(t, testDir+"/passphrase")
+	})
+
+	t.Run("WrongPassphrase", func(t *testing.T) {
+		c := car{passphrase: []byte("wrong")}
+		err := c.extract(testDir + "/test.car")
+		if err == nil {
+			t.Fatal("extraction with a wrong passphrase succeeded")
+		}
+	})
+
+	t.Run("NoKey", func(t *testing.T) {
+		c := car{}
+		extractIn(t, &c, testDir+"/nokey", testDir+"/test.car")
+		if c.error == 0 {
+			t.Fatal("extraction without keys succeeded")
+		}
+	})
+
+	// The names of two entries with data of the same size are swapped
+	t.Run("Swapped", func(t *testing.T) {
+		dir := t.TempDir()
+		err := fillFile(dir+"/first", 0o644, 'f', 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = fillFile(dir+"/other", 0o644, 'o', 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c := car{encrypt: true, passphrase: []byte("secret")}
+		err = c.archive([]string{dir}, dir+"/test.car")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := os.ReadFile(dir + "/test.car")
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = bytes.ReplaceAll(data, []byte("/first"), []byte("/tmp__"))
+		data = bytes.ReplaceAll(data, []byte("/other"), []byte("/first"))
+		data = bytes.ReplaceAll(data, []byte("/tmp__"), []byte("/other"))
+		err = os.WriteFile(dir+"/swapped.car", data, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c = car{passphrase: []byte("secret")}
+		extractIn(t, &c, dir+"/extract", dir+"/swapped.car")
+		if c.error == 0 {
+			t.Fatal("data moved to another entry was extracted")
+		}
+	})
+}
+
+func TestReadPassphrase(t *testing.T) {
+	t.Setenv("CAR_PASSPHRASE", "secret")
+	pass, err := readPassphrase("")
+	if err != nil || string(pass) != "secret" {
+		t.Fatalf("passphrase %q from the environment, error %v", pass, err)
+	}
+
+	file := t.TempDir() + "/pass"
+	err = os.WriteFile(file, []byte("from file\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pass, err = readPassphrase(file)
+	if err != nil || string(pass) != "from file" {
+		t.Fatalf("passphrase %q from the file, error %v", pass, err)
+	}
+
+	os.Unsetenv("CAR_PASSPHRASE")
+	_, err = readPassphrase("")
+	if err == nil {
+		t.Fatal("missing passphrase not reported")
+	}
+}
+
+func TestSignature(t *testing.T) {
+	err := testSetup(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := car{
+		signKey: priv,
+	}
+	err = c.archive([]string{testDir + "/create"}, testDir+"/test.car")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Verify", func(t *testing.T) {
+		extractIn(t, &car{verifyKey: pub}, testDir+"/verify", testDir+"/test.car")
+		compareTrees(t, testDir+"/verify")
+	})
+
+	t.Run("Tampered", func(t *testing.T) {
+		data, err := os.ReadFile(testDir + "/test.car")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pos := bytes.Index(data, bytes.Repeat([]byte{'p'}, 100))
+		if pos < 0 {
+			t.Fatal("file content not found in the archive")
+		}
+		data[pos] = 'P'
+
+		err = os.WriteFile(testDir+"/tampered.car", data, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c := car{verifyKey: pub}
+		err = c.extract(testDir + "/tampered.car")
+		if err == nil {
+			t.Fatal("tampered archive was extracted")
+		}
+	})
+}
+
+// writeArchive writes an archive with hand crafted entries
+func writeArchive(t *testing.T, path string, entries []entry) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	c := car{}
+	out := newArchiveWriter(f)
+	for _, e := range entries {
+		err = c.writeHeader(out, e)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = f.Write([]byte(cowEnd))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testMalicious(t *testing.T) {
+	testDir = t.TempDir()
+	outside := testDir + "/outside"
+	err := os.Mkdir(outside, 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := testDir + "/target"
+	err = os.WriteFile(target, nil, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := fixedData{Mode: unix.S_IFREG | 0o644}
+	link := fixedData{Mode: unix.S_IFLNK | 0o777}
+
+	writeArchive(t, testDir+"/evil.car", []entry{
+		// Stored by car -c ., only a directory is merged with the destination
+		{fixedData: fixedData{Mode: unix.S_IFDIR | 0o2755}, name: "."},
+		{fixedData: file, name: "./"},
+		{fixedData: file, name: "../escape"},
+		{fixedData: file, name: outside + "/absolute"},
+		{fixedData: link, name: "abslink", link: outside},
+		{fixedData: file, name: "abslink/through-absolute"},
+		{fixedData: link, name: "rellink", link: "../outside"},
+		{fixedData: file, name: "rellink/through-relative"},
+		{fixedData: fixedData{Mode: unix.S_IFDIR | 0o755}, name: "dir"},
+		{fixedData: link, name: "dir/up", link: "../.."},
+		{fixedData: file, name: "dir/up/outside/through-dotdot"},
+		{fixedData: link, name: "inside", link: "dir"},
+		{fixedData: file, name: "inside/legit"},
+		{fixedData: fixedData{Mode: unix.S_IFLNK | 0o4777}, name: "setuid", link: target},
+	})
+
+	c := car{}
+	extractIn(t, &c, testDir+"/dest", testDir+"/evil.car")
+	if c.error != 0 {
+		t.Error("errors extracting the archive")
+	}
+
+	escaped, err := os.ReadDir(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range escaped {
+		t.Errorf("%s was extracted outside the target directory", e.Name())
+	}
+
+	if _, err := os.Lstat(testDir + "/escape"); err == nil {
+		t.Error("../escape was extracted outside the target directory")
+	}
+
+	if info, err := os.Stat(target); err != nil {
+		t.Error(err)
+	} else if info.Mode() != 0o644 {
+		t.Errorf("the permissions of a symlink target were changed to %v", info.Mode())
+	}
+
+	if _, err := os.Lstat(testDir + "/dest/dir/legit"); err != nil {
+		t.Errorf("symlink inside the target directory not followed: %v", err)
+	}
+
+	if info, err := os.Stat(testDir + "/dest"); err != nil {
+		t.Error(err)
+	} else if info.Mode()&fs.ModeSetgid == 0 || !info.IsDir() {
+		t.Errorf("the metadata of . wasn't applied to the destination directory: %v", info.Mode())
+	}
+}
+
+func TestMalicious(t *testing.T) {
+	t.Run("openat2", testMalicious)
+
+	openat2Unsupported.Store(true)
+	defer openat2Unsupported.Store(false)
+	t.Run("Fallback", testMalicious)
+}
+
+func TestRecover(t *testing.T) {
+	err := testSetup(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := car{}
+	err = c.archive([]string{testDir + "/create"}, testDir+"/test.car")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(testDir + "/test.car")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Corrupted", func(t *testing.T) {
+		damaged := bytes.Clone(data)
+		name := bytes.Index(damaged, []byte("create/dir1/private"))
+		magic := bytes.LastIndex(damaged[:name], []byte(cowMagic))
+		copy(damaged[magic:], "XXXX")
+
+		err := os.WriteFile(testDir+"/corrupted.car", damaged, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c := car{}
+		err = c.extract(testDir + "/corrupted.car")
+		if err == nil {
+			t.Fatal("corrupted archive extracted without --recover")
+		}
+
+		c = car{recover: true}
+		extractIn(t, &c, testDir+"/corrupted", testDir+"/corrupted.car")
+		if c.error == 0 {
+			t.Error("damaged entry not reported")
+		}
+		if _, err := os.Lstat(testDir + "/corrupted/create/dir1/private"); err == nil {
+			t.Error("damaged entry was extracted")
+		}
+		for _, name := range []string{"dir1/exe", "dir1/readonly", "dir2/subdir/link", "toplevel"} {
+			if _, err := os.Lstat(testDir + "/corrupted/create/" + name); err != nil {
+				t.Errorf("%s not recovered: %v", name, err)
+			}
+		}
+	})
+
+	t.Run("Truncated", func(t *testing.T) {
+		name := bytes.Index(data, []byte("create/dir1/readonly"))
+
+		err := os.WriteFile(testDir+"/truncated.car", data[:name+cowAlignment], 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c := car{recover: true}
+		extractIn(t, &c, testDir+"/truncated", testDir+"/truncated.car")
+		if c.error == 0 {
+			t.Error("truncated archive not reported")
+		}
+		if _, err := os.Lstat(testDir + "/truncated/create/dir1/private"); err != nil {
+			t.Errorf("entry before the truncation not extracted: %v", err)
+		}
+	})
+
+	// The data of the damaged entry looks like an entry which sets the alignment to 1
+	t.Run("FakeEntry", func(t *testing.T) {
+		dir := t.TempDir()
+		err := os.Mkdir(dir+"/tree", 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var fake bytes.Buffer
+		fake.WriteString(cowMagic)
+		binary.Write(&fake, binary.BigEndian, []uint16{tagAlignment, 4})
+		binary.Write(&fake, binary.BigEndian, uint32(1))
+		binary.Write(&fake, binary.BigEndian, []uint16{tagData, 5})
+		err = os.WriteFile(dir+"/tree/first", fake.Bytes(), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = fillFile(dir+"/tree/second", 0o644, 's', 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c := car{}
+		err = c.archive([]string{dir + "/tree"}, dir+"/test.car")
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(dir + "/test.car")
+		if err != nil {
+			t.Fatal(err)
+		}
+		first := bytes.LastIndex(data[:bytes.Index(data, []byte("tree/first"))], []byte(cowMagic))
+		copy(data[first:], "XXXX")
+		err = os.WriteFile(dir+"/damaged.car", data, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c = car{recover: true}
+		extractIn(t, &c, dir+"/extract", dir+"/damaged.car")
+		second, err := os.ReadFile(dir + "/extract/tree/second")
+		if err != nil || !bytes.Equal(second, bytes.Repeat([]byte{'s'}, 100)) {
+			t.Errorf("entry after the fake one not recovered: %v", err)
+		}
+	})
+
+	t.Run("NotSeekable", func(t *testing.T) {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+
+		go func() {
+			w.Write(data)
+			w.Close()
+		}()
+
+		oldStdin := os.Stdin
+		os.Stdin = r
+		defer func() { os.Stdin = oldStdin }()
+
+		c := car{recover: true, list: true}
+		err = c.extract("")
+		if err == nil || !strings.Contains(err.Error(), "seekable") {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestOverwrite(t *testing.T) {
+	err := testSetup(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := car{}
+	err = c.archive([]string{testDir + "/create"}, testDir+"/test.car")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// extractOver extracts the archive over a tree where toplevel was changed
+	extractOver := func(t *testing.T, c *car, dir string, change func(string) error) {
+		extractIn(t, &car{}, dir, testDir+"/test.car")
+		err := change(dir + "/create/toplevel")
+		if err != nil {
+			t.Fatal(err)
+		}
+		extractIn(t, c, dir, testDir+"/test.car")
+	}
+	local := func(name string) error {
+		return os.WriteFile(name, []byte("local"), 0o644)
+	}
+	check := func(t *testing.T, name, content string) {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if content == "" {
+			content = string(bytes.Repeat([]byte{'t'}, 512))
+		}
+		if string(data) != content {
+			t.Errorf("%s: unexpected content", name)
+		}
+	}
+
+	t.Run("Replace", func(t *testing.T) {
+		c := car{}
+		extractOver(t, &c, testDir+"/replace", local)
+		check(t, testDir+"/replace/create/toplevel", "")
+	})
+
+	t.Run("KeepOld", func(t *testing.T) {
+		c := car{overwrite: overwriteKeepOld}
+		extractOver(t, &c, testDir+"/keep", local)
+		check(t, testDir+"/keep/create/toplevel", "local")
+		if c.error == 0 {
+			t.Error("existing files not reported")
+		}
+	})
+
+	t.Run("SkipOld", func(t *testing.T) {
+		c := car{overwrite: overwriteSkipOld}
+		extractOver(t, &c, testDir+"/skip", local)
+		check(t, testDir+"/skip/create/toplevel", "local")
+		if c.error != 0 {
+			t.Error("existing files reported as errors")
+		}
+	})
+
+	t.Run("KeepNewer", func(t *testing.T) {
+		c := car{overwrite: overwriteKeepNewer}
+		extractOver(t, &c, testDir+"/newer", func(name string) error {
+			err := local(name)
+			if err != nil {
+				return err
+			}
+			future := time.Now().Add(time.Hour)
+			return os.Chtimes(name, future, future)
+		})
+		check(t, testDir+"/newer/create/toplevel", "local")
+
+		extractOver(t, &c, testDir+"/older", func(name string) error {
+			err := local(name)
+			if err != nil {
+				return err
+			}
+			return os.Chtimes(name, time.Unix(0, 0), time.Unix(0, 0))
+		})
+		check(t, testDir+"/older/create/toplevel", "")
+
+		// The extracted files have the archived time, so they are replaced by the same archive
+		extractOver(t, &c, testDir+"/again", func(name string) error {
+			info, err := os.Stat(name)
+			if err != nil {
+				return err
+			}
+			orig, err := os.Stat(testDir + "/create/toplevel")
+			if err != nil {
+				return err
+			}
+			if !info.ModTime().Equal(orig.ModTime()) {
+				t.Errorf("extracted with time %v instead of %v", info.ModTime(), orig.ModTime())
+			}
+			err = local(name)
+			if err != nil {
+				return err
+			}
+			return os.Chtimes(name, info.ModTime(), info.ModTime())
+		})
+		check(t, testDir+"/again/create/toplevel", "")
+	})
+
+	t.Run("SimpleBackup", func(t *testing.T) {
+		c := car{backup: backupSimple}
+		extractOver(t, &c, testDir+"/simple", local)
+		check(t, testDir+"/simple/create/toplevel", "")
+		check(t, testDir+"/simple/create/toplevel~", "local")
+	})
+
+	t.Run("UnlinkFirst", func(t *testing.T) {
+		// A hard link to a file outside of the tree, which must not be written through
+		shared := testDir + "/shared"
+		c := car{unlinkFirst: true}
+		extractOver(t, &c, testDir+"/unlinkfirst", func(name string) error {
+			err := local(shared)
+			if err == nil {
+				err = os.Remove(name)
+			}
+			if err == nil {
+				err = os.Link(shared, name)
+			}
+			return err
+		})
+		check(t, testDir+"/unlinkfirst/create/toplevel", "")
+		check(t, shared, "local")
+		if c.error != 0 {
+			t.Error("errors replacing the existing files")
+		}
+	})
+
+	t.Run("Backup", func(t *testing.T) {
+		c := car{backup: backupNumbered}
+		extractOver(t, &c, testDir+"/backup", local)
+		extractIn(t, &c, testDir+"/backup", testDir+"/test.car")
+		check(t, testDir+"/backup/create/toplevel", "")
+		check(t, testDir+"/backup/create/toplevel.~1~", "local")
+		check(t, testDir+"/backup/create/toplevel.~2~", "")
+	})
+
+	t.Run("RecursiveUnlink", func(t *testing.T) {
+		mkdir := func(name string) error {
+			err := os.Remove(name)
+			if err == nil {
+				err = os.MkdirAll(name+"/subdir", 0o755)
+			}
+			return err
+		}
+
+		c := car{}
+		extractOver(t, &c, testDir+"/nonempty", mkdir)
+		if c.error == 0 {
+			t.Error("non empty directory replaced without --recursive-unlink")
+		}
+
+		c = car{recursiveUnlink: true}
+		extractOver(t, &c, testDir+"/unlink", mkdir)
+		check(t, testDir+"/unlink/create/toplevel", "")
+	})
+}
+
+func testAtomic(t *testing.T) {
+	dir := t.TempDir()
+	extractIn(t, &car{}, dir, testDir+"/test.car")
+
+	// A hard link shares the inode, which must not be written in place
+	err := os.WriteFile(dir+"/create/toplevel", []byte("old"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Link(dir+"/create/toplevel", dir+"/hardlink")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	extractIn(t, &car{}, dir, testDir+"/test.car")
+	compareTrees(t, dir)
+
+	data, err := os.ReadFile(dir + "/hardlink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "old" {
+		t.Error("existing file was overwritten in place")
+	}
+
+	err = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err == nil && strings.HasPrefix(d.Name(), ".car") {
+			t.Errorf("temporary file %s left behind", p)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAtomic(t *testing.T) {
+	err := testSetup(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := car{}
+	err = c.archive([]string{testDir + "/create"}, testDir+"/test.car")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Tmpfile", testAtomic)
+
+	tmpfileUnsupported.Store(true)
+	defer tmpfileUnsupported.Store(false)
+	t.Run("HiddenName", testAtomic)
+}
+
+// captureStdout returns what f prints on stdout
+func captureStdout(t *testing.T, f func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	oldStdout := os.Stdout
+	os.Stdout = w
+	f()
+	os.Stdout = oldStdout
+	w.Close()
+
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(out)
+}
+
+func TestDryRun(t *testing.T) {
+	err := testSetup(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := car{}
+	err = c.archive([]string{testDir + "/create"}, testDir+"/test.car")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// dryRun returns the action printed for every entry
+	dryRun := func(t *testing.T, dir, archive string) map[string]string {
+		out := captureStdout(t, func() {
+			extractIn(t, &car{dryRun: true}, dir, archive)
+		})
+
+		actions := make(map[string]string)
+		for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+			action, name, _ := strings.Cut(line, " ")
+			name, _, _ = strings.Cut(strings.TrimSpace(name), ":")
+			actions[strings.TrimSuffix(name, " (outside target directory)")] = action
+		}
+		return actions
+	}
+	expect := func(t *testing.T, actions map[string]string, name, action string) {
+		if actions[name] != action {
+			t.Errorf("%s: expected %s, got %q", name, action, actions[name])
+		}
+	}
+
+	t.Run("Empty", func(t *testing.T) {
+		actions := dryRun(t, testDir+"/empty", testDir+"/test.car")
+		expect(t, actions, "create", actionCreate)
+		for _, e := range testEntries {
+			expect(t, actions, "create/"+e.name, actionCreate)
+		}
+
+		entries, err := os.ReadDir(testDir + "/empty")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 0 {
+			t.Error("dry run modified the target directory")
+		}
+	})
+
+	t.Run("Existing", func(t *testing.T) {
+		extractIn(t, &car{}, testDir+"/existing", testDir+"/test.car")
+		err := os.Remove(testDir + "/existing/create/toplevel")
+		if err == nil {
+			err = os.MkdirAll(testDir+"/existing/create/toplevel/subdir", 0o755)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		actions := dryRun(t, testDir+"/existing", testDir+"/test.car")
+		expect(t, actions, "create/dir1", actionMerge)
+		expect(t, actions, "create/dir1/exe", actionReplace)
+		expect(t, actions, "create/toplevel", actionFail)
+	})
+
+	t.Run("Malicious", func(t *testing.T) {
+		link := fixedData{Mode: unix.S_IFLNK | 0o777}
+		writeArchive(t, testDir+"/evil.car", []entry{
+			{fixedData: fixedData{Mode: unix.S_IFREG | 0o644}, name: "../escape"},
+			{fixedData: fixedData{Mode: unix.S_IFDIR | 0o755}, name: "dir"},
+			{fixedData: link, name: "dir/link", link: "/"},
+		})
+
+		actions := dryRun(t, testDir+"/malicious", testDir+"/evil.car")
+		expect(t, actions, "../escape", actionSkip)
+		expect(t, actions, "dir", actionCreate)
+		expect(t, actions, "dir/link", actionCreate)
+	})
+}
+
+func TestParallel(t *testing.T) {
+	err := testSetup(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name string
+		c    *car
+	}{
+		{"Plain", &car{}},
+		{"Dedup", &car{dedup: true}},
+		{"Compress", &car{compress: encodingZstd}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			archive := testDir + "/" + test.name + ".car"
+			// The same files twice, so that workers write files with the same name
+			err := test.c.archive([]string{testDir + "/create", testDir + "/create"}, archive)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := car{jobs: 4}
+			extractIn(t, &c, testDir+"/"+test.name, archive)
+			if c.error != 0 {
+				t.Error("parallel extraction failed")
+			}
+			compareTrees(t, testDir+"/"+test.name)
+
+			info, err := os.Stat(testDir + "/" + test.name + "/create/dir1/readonly")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm() != 0o444 {
+				t.Errorf("wrong permissions %v", info.Mode().Perm())
+			}
+		})
+	}
+}
+
+func TestParallelWalk(t *testing.T) {
+	err := testSetup(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var archives [2][]byte
+	for i, jobs := range []int{1, 8} {
+		name := fmt.Sprintf("%s/jobs%d.car", testDir, jobs)
+		c := car{jobs: jobs}
+		err = c.archive([]string{testDir + "/create"}, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		archives[i], err = os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !bytes.Equal(archives[0], archives[1]) {
+		t.Error("parallel walk produced a different archive")
+	}
+
+	// The lookups of a large directory are started a few at a time
+	t.Run("Wide", func(t *testing.T) {
+		dir := t.TempDir()
+		for i := 0; i < 1000; i++ {
+			err := os.WriteFile(fmt.Sprintf("%s/%04d", dir, i), nil, 0o644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		base := runtime.NumGoroutine()
+		peak := 0
+		c := car{jobs: 4}
+		err := c.walkParallel(dir, func(path string, info fs.FileInfo, err error) error {
+			peak = max(peak, runtime.NumGoroutine()-base)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if peak > 2*c.jobs {
+			t.Errorf("%d lookups running at once", peak)
+		}
+	})
+}
+
+// benchmarkWalk archives a tree of many small files
+func benchmarkWalk(b *testing.B, jobs int) {
+	dir := b.TempDir()
+	for i := 0; i < 50; i++ {
+		sub := fmt.Sprintf("%s/tree/dir%d", dir, i)
+		err := os.MkdirAll(sub, 0o755)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for j := 0; j < 40; j++ {
+			err = os.WriteFile(fmt.Sprintf("%s/file%d", sub, j), nil, 0o644)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c := car{jobs: jobs}
+		err := c.archive([]string{dir + "/tree"}, dir+"/test.car")
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWalk(b *testing.B) {
+	b.Run("Serial", func(b *testing.B) { benchmarkWalk(b, 1) })
+	b.Run("Parallel", func(b *testing.B) { benchmarkWalk(b, 8) })
+}
+
+func TestCopyContent(t *testing.T) {
+	dir := t.TempDir()
+	data := bytes.Repeat([]byte("0123456789"), 10000)
+	err := os.WriteFile(dir+"/in", data, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in, err := os.Open(dir + "/in")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+
+	t.Run("File", func(t *testing.T) {
+		out, err := os.Create(dir + "/out")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer out.Close()
+
+		method, err := copyContent(out, in, 10, int64(len(data)-10))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Log("copied with", method)
+
+		copied, err := os.ReadFile(dir + "/out")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(copied, data[10:]) {
+			t.Error("copied data differs")
+		}
+	})
+
+	t.Run("Pipe", func(t *testing.T) {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+
+		copied := make(chan []byte)
+		go func() {
+			data, _ := io.ReadAll(r)
+			copied <- data
+		}()
+
+		method, err := copyContent(w, in, 0, int64(len(data)))
+		w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Log("copied with", method)
+
+		if !bytes.Equal(<-copied, data) {
+			t.Error("copied data differs")
+		}
+	})
+}
+
+// mockClone emulates reflink with a copy, with the same alignment constraints, and counts the bytes cloned
+func mockClone(cloned *uint64) func(dst, src *os.File, srcOffset, length, dstOffset uint64) error {
+	return func(dst, src *os.File, srcOffset, length, dstOffset uint64) error {
+		info, err := src.Stat()
+		if err != nil {
+			return err
+		}
+		srcSize := uint64(info.Size())
+
+		// Only the last block of the source can be partial
+		if srcOffset%cowAlignment != 0 || dstOffset%cowAlignment != 0 || srcOffset+length > srcSize ||
+			length%cowAlignment != 0 && srcOffset+length != srcSize {
+			return unix.EINVAL
+		}
+
+		buf := make([]byte, length)
+		_, err = src.ReadAt(buf, int64(srcOffset))
+		if err != nil {
+			return err
+		}
+		_, err = dst.WriteAt(buf, int64(dstOffset))
+		if err != nil {
+			return err
+		}
+
+		*cloned += length
+		return nil
+	}
+}
+
+func TestReflink(t *testing.T) {
+	err := testSetup(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var size, aligned, cloned uint64
+	for _, e := range testEntries {
+		if e.mode.IsRegular() {
+			size += e.size
+			aligned += roundUp(e.size, cowAlignment)
+		}
+	}
+
+	cloneFile = mockClone(&cloned)
+	defer func() { cloneFile = cloneRange }()
+
+	c := car{}
+	err = c.archive([]string{testDir + "/create"}, testDir+"/test.car")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cloned != size {
+		t.Errorf("%d bytes cloned into the archive instead of %d", cloned, size)
+	}
+	if c.reflinked.Load() != size || c.copied.Load() != 0 {
+		t.Errorf("counted %d bytes reflinked and %d copied, instead of %d and 0", c.reflinked.Load(), c.copied.Load(), size)
+	}
+
+	cloned = 0
+	x := &car{}
+	extractIn(t, x, testDir+"/extract", testDir+"/test.car")
+	if cloned != aligned {
+		t.Errorf("%d bytes cloned from the archive instead of %d", cloned, aligned)
+	}
+	if x.reflinked.Load() != size || x.copied.Load() != 0 {
+		t.Errorf("counted %d bytes reflinked and %d copied, instead of %d and 0", x.reflinked.Load(), x.copied.Load(), size)
+	}
+	compareTrees(t, testDir+"/extract")
+}
+
+func TestRequireReflink(t *testing.T) {
+	err := testSetup(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var size uint64
+	for _, e := range testEntries {
+		if e.mode.IsRegular() {
+			size += e.size
+		}
+	}
+
+	cloneFile = func(dst, src *os.File, srcOffset, length, dstOffset uint64) error {
+		return unix.EXDEV
+	}
+	defer func() { cloneFile = cloneRange }()
+
+	c := car{}
+	err = c.archive([]string{testDir + "/create"}, testDir+"/test.car")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.reflinked.Load() != 0 || c.copied.Load() != size {
+		t.Errorf("counted %d bytes reflinked and %d copied, instead of 0 and %d", c.reflinked.Load(), c.copied.Load(), size)
+	}
+
+	c = car{requireReflink: true}
+	err = c.archive([]string{testDir + "/create"}, testDir+"/required.car")
+	if err == nil || !strings.Contains(err.Error(), testDir+"/create/") || !strings.Contains(err.Error(), "EXDEV") {
+		t.Errorf("archiving without reflink didn't fail with the file name and the errno: %v", err)
+	}
+
+	x := &car{requireReflink: true}
+	extractIn(t, x, testDir+"/extract", testDir+"/test.car")
+	if x.error == 0 {
+		t.Error("extracting without reflink didn't fail")
+	}
+	if x.copied.Load() != 0 {
+		t.Errorf("%d bytes copied instead of failing", x.copied.Load())
+	}
+}
+
+func TestNoReflink(t *testing.T) {
+	err := testSetup(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var size uint64
+	for _, e := range testEntries {
+		if e.mode.IsRegular() {
+			size += e.size
+		}
+	}
+
+	var cloned uint64
+	cloneFile = mockClone(&cloned)
+	defer func() { cloneFile = cloneRange }()
+
+	t.Run("Copy", func(t *testing.T) {
+		cloned = 0
+		c := car{noReflink: true}
+		err := c.archive([]string{testDir + "/create"}, testDir+"/test.car")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		x := &car{noReflink: true}
+		extractIn(t, x, testDir+"/copy", testDir+"/test.car")
+		if cloned != 0 {
+			t.Errorf("%d bytes cloned", cloned)
+		}
+		if c.copied.Load() != size || x.copied.Load() != size {
+			t.Errorf("%d bytes copied into the archive and %d from it, instead of %d", c.copied.Load(), x.copied.Load(), size)
+		}
+		compareTrees(t, testDir+"/copy")
+	})
+
+	t.Run("Compact", func(t *testing.T) {
+		cloned = 0
+		c := car{compact: true}
+		err := c.archive([]string{testDir + "/create"}, testDir+"/compact.car")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cloned != 0 || c.padded.Load() != 0 {
+			t.Errorf("%d bytes cloned and %d of padding", cloned, c.padded.Load())
+		}
+
+		info, err := os.Stat(testDir + "/compact.car")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size()%cowAlignment == 0 {
+			t.Errorf("compact archive size %d is aligned", info.Size())
+		}
+
+		extractIn(t, &car{}, testDir+"/compact", testDir+"/compact.car")
+		compareTrees(t, testDir+"/compact")
+	})
+}
+
+func TestPipeOutput(t *testing.T) {
+	err := testSetup(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The alignment of a pipe is the default one
+	fsBlockSize = func(*os.File) uint64 { return cowAlignment }
+	defer func() { fsBlockSize = blockSize }()
+
+	c := car{}
+	err = c.archive([]string{testDir + "/create"}, testDir+"/test.car")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	piped := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(r)
+		piped <- data
+	}()
+
+	oldStdout := os.Stdout
+	os.Stdout = w
+	err = (&car{}).archive([]string{testDir + "/create"}, "")
+	os.Stdout = oldStdout
+	w.Close()
+	data := <-piped
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seekable, err := os.ReadFile(testDir + "/test.car")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, seekable) {
+		t.Fatalf("archive written to a pipe differs from the seekable one, %d bytes instead of %d", len(data), len(seekable))
+	}
+
+	// The saved stream can be reflinked, mockClone refuses unaligned data
+	err = os.WriteFile(testDir+"/piped.car", data, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cloned uint64
+	cloneFile = mockClone(&cloned)
+	defer func() { cloneFile = cloneRange }()
+
+	x := &car{}
+	extractIn(t, x, testDir+"/extract", testDir+"/piped.car")
+	if x.copied.Load() != 0 {
+		t.Errorf("%d bytes copied instead of reflinked", x.copied.Load())
+	}
+	compareTrees(t, testDir+"/extract")
+}
+
+// A streamed archive goes through a pipe only to be decompressed
+func TestOpenStream(t *testing.T) {
+	err := testSetup(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name       string
+		compressed bool
+	}{
+		{"test.car", false},
+		{"test.car.zst", true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := car{}
+			if test.compressed {
+				c.streamCompress = encodingZstd
+			}
+			err := c.archive([]string{testDir + "/create"}, testDir+"/"+test.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(testDir + "/" + test.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r, w, err := os.Pipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+
+			go func() {
+				w.Write(data)
+				w.Close()
+			}()
+
+			x := car{alignment: cowAlignment}
+			archive, stream, err := x.openStream(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (stream != nil) != test.compressed {
+				t.Errorf("pipe used: %v", stream != nil)
+			}
+			if stream == nil && archive != r {
+				t.Error("uncompressed stream not read directly")
+			}
+
+			e, err := x.readEntry(archive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e.format == nil {
+				t.Error("archive header not read")
+			}
+
+			if stream != nil {
+				err = closeStream(archive, stream, nil)
+			} else {
+				_, err = io.Copy(io.Discard, archive)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// Archiving to a character device, which is seekable but can't be preallocated or truncated
+func TestDevNull(t *testing.T) {
+	err := testSetup(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []*car{{}, {compress: encodingZstd}, {compact: true}} {
+		err = c.archive([]string{testDir + "/create"}, os.DevNull)
+		if err != nil {
+			t.Errorf("compression %d, compact %v: %v", c.compress, c.compact, err)
+		}
+	}
+}
+
+func TestSpool(t *testing.T) {
+	err := testSetup(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := car{}
+	err = c.archive([]string{testDir + "/create"}, testDir+"/test.car")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(testDir + "/test.car")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cloned uint64
+	cloneFile = mockClone(&cloned)
+	defer func() { cloneFile = cloneRange }()
+
+	// extractPipe extracts the archive read from a pipe, like in ssh host car -c dir | car -x
+	extractPipe := func(t *testing.T, x *car, dir string) {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+
+		go func() {
+			w.Write(data)
+			w.Close()
+		}()
+
+		oldStdin := os.Stdin
+		os.Stdin = r
+		defer func() { os.Stdin = oldStdin }()
+
+		extractIn(t, x, dir, "")
+	}
+
+	for dir, file := range map[string]string{"temporary": "", "kept": testDir + "/spool.car"} {
+		x := &car{spool: true, spoolFile: file}
+		extractPipe(t, x, testDir+"/"+dir)
+		if x.copied.Load() != 0 {
+			t.Errorf("%s spool: %d bytes copied instead of reflinked", dir, x.copied.Load())
+		}
+		compareTrees(t, testDir+"/"+dir)
+	}
+
+	spool, err := os.ReadFile(testDir + "/spool.car")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(spool, data) {
+		t.Error("the spool differs from the archive")
+	}
+}
+
+func TestDedupeExisting(t *testing.T) {
+	err := testSetup(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := car{}
+	err = c.archive([]string{testDir + "/create"}, testDir+"/test.car")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dest := testDir + "/extract"
+	extractIn(t, &car{}, dest, testDir+"/test.car")
+
+	inode := func(name string) uint64 {
+		var st unix.Stat_t
+		err := unix.Lstat(dest+"/create/"+name, &st)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return st.Ino
+	}
+
+	// A hard link held elsewhere, a file with different content and one with different permissions
+	err = os.Link(dest+"/create/dir2/4k", dest+"/4k_link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fillFile(dest+"/create/dir2/200", 0, 'X', 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chmod(dest+"/create/toplevel", 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept, changed, chmodded := inode("dir2/4k"), inode("dir2/200"), inode("toplevel")
+
+	extractIn(t, &car{dedupeExisting: true}, dest, testDir+"/test.car")
+	compareTrees(t, dest)
+
+	if inode("dir2/4k") != kept || inode("toplevel") != chmodded {
+		t.Error("identical files were replaced")
+	}
+	if inode("dir2/200") == changed {
+		t.Error("file with different content was kept")
+	}
+	if inode("../4k_link") != kept {
+		t.Error("hard link was broken")
+	}
+	if info, err := os.Stat(dest + "/create/toplevel"); err != nil || info.Mode().Perm() != 0o644 {
+		t.Errorf("permissions of the kept file not updated: %v %v", info.Mode(), err)
+	}
+}
+
+func TestFreeSpace(t *testing.T) {
+	err := testSetup(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := car{}
+	err = c.archive([]string{testDir + "/create"}, testDir+"/test.car")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = car{compress: encodingZstd}
+	err = c.archive([]string{testDir + "/create"}, testDir+"/compressed.car")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(testDir + "/compressed.car")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	free := uint64(cowAlignment)
+	fsFree = func(int) (uint64, error) { return free, nil }
+	defer func() { fsFree = freeSpace }()
+
+	var cloned uint64
+	cloneFile = mockClone(&cloned)
+	defer func() { cloneFile = cloneRange }()
+
+	// When the data can be reflinked it takes no space
+	extractIn(t, &car{}, testDir+"/reflink", testDir+"/test.car")
+	compareTrees(t, testDir+"/reflink")
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+
+	// extractFull extracts into a filesystem which can't hold the files
+	extractFull := func(t *testing.T, c *car, dir, archive string) {
+		err := os.MkdirAll(dir, 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Chdir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = c.extract(archive)
+		if err == nil || !strings.Contains(err.Error(), "not enough space") {
+			t.Errorf("extraction into a full filesystem didn't fail early: %v", err)
+		}
+		if _, err := os.Lstat(dir + "/create"); err == nil {
+			t.Error("entries extracted into a full filesystem")
+		}
+	}
+
+	t.Run("NoReflink", func(t *testing.T) {
+		extractFull(t, &car{noReflink: true}, testDir+"/copy", testDir+"/test.car")
+	})
+
+	// The probe reflink works, but compressed data is copied anyway
+	t.Run("CompressedReflink", func(t *testing.T) {
+		extractFull(t, &car{}, testDir+"/compressed-reflink", testDir+"/compressed.car")
+	})
+
+	// Like on ext4, the archive is on the same filesystem but the data is copied
+	cloneFile = func(dst, src *os.File, srcOffset, length, dstOffset uint64) error {
+		return unix.EOPNOTSUPP
+	}
+
+	t.Run("Unsupported", func(t *testing.T) {
+		extractFull(t, &car{}, testDir+"/unsupported", testDir+"/test.car")
+	})
+
+	// The archive fits, but not the decompressed files
+	t.Run("Compressed", func(t *testing.T) {
+		free = uint64(info.Size())
+		extractFull(t, &car{}, testDir+"/compressed", testDir+"/compressed.car")
+	})
+}
+
+func TestProgress(t *testing.T) {
+	err := testSetup(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, bytes := scanPaths([]string{testDir + "/create"})
+	if entries != uint64(len(testEntries))+1 {
+		t.Errorf("scanned %d entries instead of %d", entries, len(testEntries)+1)
+	}
+
+	log := testDir + "/checkpoints"
+	c := car{
+		checkpoint:        2,
+		checkpointActions: []string{"exec=echo $CAR_CHECKPOINT $CAR_ENTRIES >> " + log},
+	}
+	c.progress.show = true
+	err = c.archive([]string{testDir + "/create"}, testDir+"/test.car")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.progress.entries != entries || c.progress.bytes != bytes || c.progress.totalBytes != bytes {
+		t.Errorf("progress %d entries, %d/%d bytes, instead of %d entries and %d bytes",
+			c.progress.entries, c.progress.bytes, c.progress.totalBytes, entries, bytes)
+	}
+
+	data, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if uint64(len(lines)) != entries/2 || lines[0] != "1 2" {
+		t.Errorf("checkpoint actions run as %q", lines)
+	}
+
+	x := &car{}
+	x.progress.show = true
+	extractIn(t, x, testDir+"/extract", testDir+"/test.car")
+	info, err := os.Stat(testDir + "/test.car")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x.progress.entries != entries || x.progress.bytes != uint64(info.Size()) {
+		t.Errorf("progress %d entries and %d bytes, instead of %d and %d", x.progress.entries, x.progress.bytes, entries, info.Size())
+	}
+}
+
+func TestAlignment(t *testing.T) {
+	err := testSetup(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fsBlockSize = func(*os.File) uint64 { return maxAlignment }
+	defer func() { fsBlockSize = blockSize }()
+
+	c := car{}
+	err = c.archive([]string{testDir + "/create"}, testDir+"/test.car")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(testDir + "/test.car")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data)%maxAlignment != 0 {
+		t.Errorf("archive size %d is not aligned", len(data))
+	}
+
+	// Readers which don't know the alignment tag must refuse the archive
+	f, err := os.Open(testDir + "/test.car")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	header, err := (&car{alignment: cowAlignment}).readEntry(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.format == nil || header.format.Features&featureAlignment == 0 {
+		t.Error("alignment feature not set in the archive header")
+	}
+	for _, e := range testEntries {
+		if !e.mode.IsRegular() || e.size == 0 || e.content == 0 {
+			continue
+		}
+		pos := bytes.Index(data, bytes.Repeat([]byte{e.content}, int(e.size)))
+		if pos%maxAlignment != 0 {
+			t.Errorf("%s: data at offset %d is not aligned", e.name, pos)
+		}
+	}
+
+	extractIn(t, &car{}, testDir+"/extract", testDir+"/test.car")
+	compareTrees(t, testDir+"/extract")
+}
+
+// writeTagged writes an empty file entry, with an additional tag before the data
+func writeTagged(t *testing.T, f *os.File, name string, extra uint16) {
+	c := car{}
+	fd := fixedData{Mode: unix.S_IFREG | 0o644}
+	out := newArchiveWriter(f)
+
+	_, err := out.Write([]byte(cowMagic))
+	if err == nil {
+		err = c.writeTag(tagHeader, uint16(binary.Size(fd)), out, &fd)
+	}
+	if err == nil {
+		err = c.writeTag(tagName, uint16(len(name)), out, []byte(name))
+	}
+	if err == nil {
+		err = c.writeTag(extra, 4, out, []byte("abcd"))
+	}
+	if err == nil {
+		err = c.writeTag(tagData, 0, out, nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnknownTags(t *testing.T) {
+	testDir = t.TempDir()
+
+	f, err := os.Create(testDir + "/future.car")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTagged(t, f, "optional", 0x7fff)
+	writeTagged(t, f, "critical", tagCritical|0x7fff)
+	writeTagged(t, f, "last", 0x0100)
+	_, err = f.Write([]byte(cowEnd))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := car{}
+	extractIn(t, &c, testDir+"/dest", testDir+"/future.car")
+
+	if c.error == 0 {
+		t.Error("entry with an unknown critical tag not reported")
+	}
+	if _, err := os.Lstat(testDir + "/dest/critical"); err == nil {
+		t.Error("entry with an unknown critical tag was extracted")
+	}
+	for _, name := range []string{"optional", "last"} {
+		if _, err := os.Lstat(testDir + "/dest/" + name); err != nil {
+			t.Errorf("%s not extracted: %v", name, err)
+		}
+	}
+
+	t.Run("Version", func(t *testing.T) {
+		f, err := os.Create(testDir + "/version.car")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		c := car{}
+		fd := formatData{Version: formatVersion + 1}
+		out := newArchiveWriter(f)
+		_, err = out.Write([]byte(cowMagic))
+		if err == nil {
+			err = c.writeTag(tagFormat, uint16(binary.Size(fd)), out, &fd)
+		}
+		if err == nil {
+			err = c.writeTag(tagData, 0, out, nil)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeTagged(t, f, "file", 0x7fff)
+		_, err = f.Write([]byte(cowEnd))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = c.extract(testDir + "/version.car")
+		if err == nil {
+			t.Fatal("archive with a newer format was extracted")
+		}
+	})
+}
+
+// fuzzSeeds adds to the corpus archives of two small identical files, created with different options.
+// They are compact, as the padding makes the inputs too big to be fuzzed
+func fuzzSeeds(f *testing.F) {
+	dir := f.TempDir()
+	for _, name := range []string{"a", "b"} {
+		err := os.WriteFile(dir+"/"+name, []byte(strings.Repeat("hello ", 50)), 0o644)
+		if err != nil {
+			f.Fatal(err)
+		}
+	}
+
+	for i, c := range []*car{
+		{compact: true},
+		{compact: true, dedup: true},
+		{compact: true, compress: encodingZstd},
+		{compact: true, encrypt: true, passphrase: []byte("secret")},
+	} {
+		name := fmt.Sprintf("%s/seed%d.car", f.TempDir(), i)
+
+		err := c.archive([]string{dir}, name)
+		if err != nil {
+			f.Fatal(err)
+		}
+
+		data, err := os.ReadFile(name)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+}
+
+func FuzzList(f *testing.F) {
+	fuzzSeeds(f)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		name := t.TempDir() + "/fuzz.car"
+		err := os.WriteFile(name, data, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c := car{
+			list:    true,
+			verbose: true,
+		}
+
+		devNull, err := os.Open(os.DevNull)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer devNull.Close()
+
+		oldStdout := os.Stdout
+		os.Stdout = devNull
+		c.extract(name)
+		os.Stdout = oldStdout
+	})
+}
+
+func FuzzExtract(f *testing.F) {
+	fuzzSeeds(f)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		dir := t.TempDir()
+		err := os.WriteFile(dir+"/fuzz.car", data, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cwd, err := os.Getwd()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = os.Mkdir(dir+"/dest", 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = os.Chdir(dir + "/dest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Chdir(cwd)
+
+		c := car{}
+		c.extract(dir + "/fuzz.car")
+
+		// Make sure the extracted tree can be cleaned up
+		filepath.Walk(dir+"/dest", func(p string, info fs.FileInfo, err error) error {
+			if err == nil && info.IsDir() {
+				os.Chmod(p, 0o755)
+			}
+			return nil
+		})
+	})
+}
@@ -1,24 +1,55 @@
 package main
 
 import (
+	"crypto/ed25519"
+	"crypto/sha256"
 	"errors"
 	"io"
-	"io/fs"
+	"sync"
+	"sync/atomic"
 )
 
+// Default alignment of the data, used when the block size is unknown and by old archives
 const cowAlignment = 4096
-const cowMask = cowAlignment - 1
+
+// Largest supported block size, as on systems with 64K pages
+const maxAlignment = 64 * 1024
 const cowMagic = "CAR!"
 const cowEnd = "!RAC"
 
+/* Tags with this bit set change the meaning of the data, so a reader which doesn't
+ * know them must refuse the entry, while the other unknown tags can be ignored */
+const tagCritical uint16 = 0x8000
+
 const (
 	tagHeader uint16 = iota + 1
 	tagName
 	tagData
 	tagLinkTarget
 	tagDevice
+	tagDataRef    = tagCritical | (iota + 1)
+	tagEncoding   = tagCritical | (iota + 1)
+	tagEncryption = tagCritical | (iota + 1)
+	tagCipher     = tagCritical | (iota + 1)
+	tagSignature  = iota + 1
+	tagFormat     = iota + 1
+	tagAlignment  = iota + 1
+)
+
+// Version of the archive format, and the features it can contain
+const formatVersion = 1
+
+const (
+	featureDedup uint32 = 1 << iota
+	featureCompression
+	featureEncryption
+	featureSignature
+	// The data isn't aligned to 4 KiB, which the readers without tagAlignment assume
+	featureAlignment
 )
 
+const knownFeatures = featureDedup | featureCompression | featureEncryption | featureSignature | featureAlignment
+
 type fixedData struct {
 	Mode  uint32
 	Uid   uint32
@@ -33,6 +64,38 @@ type entry struct {
 	localName string
 	link      string
 	dev       uint32
+	ref       uint64
+	// Offset of the data in the archive, when seekable, and the padding before it
+	offset   int64
+	padding  uint32
+	stored   uint64
+	encoding uint16
+	nonce    []byte
+	// Name of the entry which stored the data, it's the entry itself unless deduplicated
+	owner string
+
+	hasHeader bool
+
+	// Unknown critical tag, which prevents the entry from being extracted
+	unsupported uint16
+
+	// Archive level records
+	format     *formatData
+	encryption []byte
+	signature  []byte
+}
+
+// payload returns the number of data bytes stored after the entry header
+func (e *entry) payload() uint64 {
+	if e.ref != 0 {
+		return 0
+	}
+	return e.stored
+}
+
+// archiveRecord tells if the entry is a record about the whole archive rather than a file
+func (e *entry) archiveRecord() bool {
+	return !e.hasHeader && e.name == ""
 }
 
 /*
@@ -49,6 +112,24 @@ type paddedData struct {
 	Padding uint32
 }
 
+// Offset and size of data already stored in the archive by a previous entry
+type dataRef struct {
+	Offset uint64
+	Size   uint64
+}
+
+// Encoding of the stored data, and the size of the file once decoded
+type encodedData struct {
+	Encoding uint16
+	Size     uint64
+}
+
+// Format version and features used, recorded at the start of the archive
+type formatData struct {
+	Version  uint16
+	Features uint32
+}
+
 type archive interface {
 	archive(paths []string, outFile string) error
 	extract(inFile string) error
@@ -56,7 +137,13 @@ type archive interface {
 
 type dirMode struct {
 	name string
-	mode fs.FileMode
+	mode uint32
+}
+
+// The modification time of a directory is set when nothing else is extracted into it
+type dirTime struct {
+	name  string
+	mtime int64
 }
 
 type car struct {
@@ -66,12 +153,117 @@ type car struct {
 	infoFd    io.Writer
 	superUser bool
 	dirModes  []dirMode
+	dirTimes  []dirTime
 	destDir   string
+	destFd    int
 	seekable  bool
+	// The magic of the first entry was read from a non seekable archive by openStream
+	magicRead bool
+	// Size of the archive, when it's a regular file
+	archiveSize int64
+	// Alignment of the data in the archive, the block size of its filesystem
+	alignment uint64
+	// Skip the damaged entries instead of stopping
+	recover bool
+	// Save a non seekable archive into a file before extracting it, with a name to keep it
+	spool     bool
+	spoolFile string
+
+	// Handling of the existing files on extraction
+	overwrite       int
+	unlinkFirst     bool
+	recursiveUnlink bool
+	backup          int
+	dedupeExisting  bool
+
+	// Only report what extraction would do, with the type of the entries which would be created
+	dryRun  bool
+	planned map[string]uint32
+
+	// Workers writing the file contents, and the names of the files being written
+	jobs    int
+	tasks   chan func()
+	workers sync.WaitGroup
+	pending map[string]bool
+	mutex   sync.Mutex
+
+	// Options to create reproducible archives
+	deterministic bool
+	sortNames     bool
+	setMtime      bool
+	clampMtime    bool
+	mtime         int64
+	forceUid      bool
+	uid           uint32
+	forceGid      bool
+	gid           uint32
+
+	// Data of the file contents already archived, by SHA-256
+	dedup  bool
+	hashes map[[sha256.Size]byte]storedData
+
+	compress uint16
+
+	// Compression of the whole archive
+	streamCompress uint16
+
+	// Payload encryption, payloadKey is set once the file key is generated or unwrapped
+	encrypt    bool
+	recipients [][]byte
+	identities [][]byte
+	passphrase []byte
+	payloadKey []byte
+	// Names of the entries storing encrypted data, by offset, to authenticate the references to it
+	dataNames map[uint64]string
+
+	// How the data of the last file was archived, printed in verbose mode
+	method string
+
+	// Fail instead of copying the data which can't be reflinked, or never try to reflink it
+	requireReflink bool
+	noReflink      bool
+
+	// Don't align the data, for archives which won't be reflinked
+	compact bool
+
+	// Progress report, and actions run every checkpoint entries
+	progress          progress
+	checkpoint        uint64
+	checkpointActions []string
+
+	// Bytes of file data reflinked or copied, and of alignment padding, printed with --totals
+	reflinked atomic.Uint64
+	copied    atomic.Uint64
+	padded    atomic.Uint64
+
+	signKey   ed25519.PrivateKey
+	verifyKey ed25519.PublicKey
+}
+
+// Location of some data stored in the archive
+type storedData struct {
+	offset   uint64
+	size     uint64
+	encoding uint16
+	nonce    []byte
+	// Entry which stored the data, its name authenticates encrypted data
+	name string
 }
 
 var reflinkError = errors.New("reflink not supported")
 
-func round4k(size uint64) uint64 {
-	return (size + cowMask) & ^uint64(cowMask)
+// fsBlockSize is a variable so that tests can simulate filesystems with larger blocks
+var fsBlockSize = blockSize
+
+// validAlignment returns the block size if usable as alignment, otherwise the default one
+func validAlignment(size uint64) uint64 {
+	if size < cowAlignment || size > maxAlignment || size&(size-1) != 0 {
+		return cowAlignment
+	}
+	return size
+}
+
+// roundUp rounds size up to a multiple of alignment, which must be a power of two
+func roundUp(size, alignment uint64) uint64 {
+	return (size + alignment - 1) & ^(alignment - 1)
 }
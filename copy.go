@@ -0,0 +1,26 @@
+package main
+
+import (
+	"io"
+	"os"
+)
+
+// Methods used to copy the file contents, printed in verbose mode
+const (
+	methodReflink   = "reflink"
+	methodCopyRange = "copy_file_range"
+	methodSplice    = "splice"
+	methodCopy      = "copy"
+)
+
+// copyPlain copies the data in userspace
+func copyPlain(out *os.File, in *os.File, offset int64, size int64) error {
+	var r io.Reader = in
+	if offset >= 0 {
+		r = io.NewSectionReader(in, offset, size)
+	}
+
+	_, err := io.CopyN(out, r, size)
+
+	return err
+}
@@ -0,0 +1,95 @@
+//go:build linux
+
+package main
+
+import (
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// copyUnsupported tells if a copy_file_range() or splice() error means that the files can't be used with it
+func copyUnsupported(err error) bool {
+	switch err {
+	case unix.ENOSYS, unix.EXDEV, unix.EINVAL, unix.EOPNOTSUPP, unix.EBADF:
+		return true
+	}
+	return false
+}
+
+// copyFileRange copies the data in kernel, or server side on NFS, between two files
+func copyFileRange(out *os.File, in *os.File, offset int64, size int64) (int64, error) {
+	var off *int64
+	if offset >= 0 {
+		off = &offset
+	}
+
+	var done int64
+	for done < size {
+		n, err := unix.CopyFileRange(int(in.Fd()), off, int(out.Fd()), nil, int(size-done), 0)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return done, err
+		}
+		if n == 0 {
+			return done, io.ErrUnexpectedEOF
+		}
+		done += int64(n)
+	}
+
+	return done, nil
+}
+
+func isPipe(f *os.File) bool {
+	var st unix.Stat_t
+	return unix.Fstat(int(f.Fd()), &st) == nil && st.Mode&unix.S_IFMT == unix.S_IFIFO
+}
+
+// spliceFile moves the data in kernel between a file and a pipe
+func spliceFile(out *os.File, in *os.File, offset int64, size int64) (int64, error) {
+	if !isPipe(in) && !isPipe(out) {
+		return 0, unix.EINVAL
+	}
+
+	var off *int64
+	if offset >= 0 {
+		off = &offset
+	}
+
+	var done int64
+	for done < size {
+		n, err := unix.Splice(int(in.Fd()), off, int(out.Fd()), nil, int(size-done), unix.SPLICE_F_MOVE)
+		if err == unix.EINTR || err == unix.EAGAIN {
+			continue
+		}
+		if err != nil {
+			return done, err
+		}
+		if n == 0 {
+			return done, io.ErrUnexpectedEOF
+		}
+		done += n
+	}
+
+	return done, nil
+}
+
+/* copyContent copies size bytes from in, at offset or at the current position if negative,
+ * to out at its current position. It tries copy_file_range() first, then splice() if one of
+ * the files is a pipe, then a plain copy, and returns the method which worked */
+func copyContent(out *os.File, in *os.File, offset int64, size int64) (string, error) {
+	done, err := copyFileRange(out, in, offset, size)
+	if err == nil || done > 0 || !copyUnsupported(err) {
+		return methodCopyRange, err
+	}
+
+	done, err = spliceFile(out, in, offset, size)
+	if err == nil || done > 0 || !copyUnsupported(err) {
+		return methodSplice, err
+	}
+
+	return methodCopy, copyPlain(out, in, offset, size)
+}
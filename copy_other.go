@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+func copyContent(out *os.File, in *os.File, offset int64, size int64) (string, error) {
+	return methodCopy, copyPlain(out, in, offset, size)
+}
@@ -0,0 +1,516 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+)
+
+/* Keys use the same encoding as age (https://age-encryption.org),
+ * so they can be generated with age-keygen or car --keygen */
+const recipientPrefix = "age"
+const identityPrefix = "AGE-SECRET-KEY-"
+
+const (
+	stanzaX25519 uint8 = iota + 1
+	stanzaScrypt
+)
+
+const fileKeySize = 32
+const wrappedKeySize = fileKeySize + chacha20poly1305.Overhead
+const scryptLogN = 16
+const maxScryptLogN = 22
+
+// Payloads are encrypted in chunks of this size, each one with its own authentication tag
+const chunkSize = 64 * 1024
+
+// Random part of the nonce, the remaining 8 bytes are the chunk counter and the last chunk flag
+const noncePrefixSize = 16
+
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+func bech32Polymod(values []byte) uint32 {
+	gen := [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := 0; i < 5; i++ {
+			if (top>>i)&1 == 1 {
+				chk ^= gen[i]
+			}
+		}
+	}
+	return chk
+}
+
+func bech32HrpExpand(hrp string) []byte {
+	ret := make([]byte, 0, len(hrp)*2+1)
+	for _, c := range hrp {
+		ret = append(ret, byte(c>>5))
+	}
+	ret = append(ret, 0)
+	for _, c := range hrp {
+		ret = append(ret, byte(c&31))
+	}
+	return ret
+}
+
+// convertBits regroups a slice of from-bit words into to-bit words
+func convertBits(data []byte, from, to uint, pad bool) ([]byte, error) {
+	var acc, bits uint
+	var ret []byte
+	maxv := uint(1)<<to - 1
+	for _, v := range data {
+		acc = acc<<from | uint(v)
+		bits += from
+		for bits >= to {
+			bits -= to
+			ret = append(ret, byte(acc>>bits&maxv))
+		}
+	}
+	if pad {
+		if bits > 0 {
+			ret = append(ret, byte(acc<<(to-bits)&maxv))
+		}
+	} else if bits >= from || acc<<(to-bits)&maxv != 0 {
+		return nil, errors.New("invalid padding")
+	}
+	return ret, nil
+}
+
+func bech32Encode(hrp string, data []byte) string {
+	values, _ := convertBits(data, 8, 5, true)
+	polymod := bech32Polymod(append(append(bech32HrpExpand(hrp), values...), 0, 0, 0, 0, 0, 0)) ^ 1
+
+	var s strings.Builder
+	s.WriteString(hrp)
+	s.WriteByte('1')
+	for _, v := range values {
+		s.WriteByte(bech32Charset[v])
+	}
+	for i := 0; i < 6; i++ {
+		s.WriteByte(bech32Charset[(polymod>>(5*(5-i)))&31])
+	}
+	return s.String()
+}
+
+func bech32Decode(s string) (string, []byte, error) {
+	if strings.ToLower(s) != s && strings.ToUpper(s) != s {
+		return "", nil, errors.New("mixed case key")
+	}
+	s = strings.ToLower(s)
+
+	pos := strings.LastIndexByte(s, '1')
+	if pos < 1 || pos+7 > len(s) {
+		return "", nil, errors.New("invalid key separator")
+	}
+
+	hrp := s[:pos]
+	values := make([]byte, 0, len(s)-pos-1)
+	for _, c := range s[pos+1:] {
+		v := strings.IndexRune(bech32Charset, c)
+		if v < 0 {
+			return "", nil, errors.New("invalid key character")
+		}
+		values = append(values, byte(v))
+	}
+
+	if bech32Polymod(append(bech32HrpExpand(hrp), values...)) != 1 {
+		return "", nil, errors.New("invalid key checksum")
+	}
+
+	data, err := convertBits(values[:len(values)-6], 5, 8, false)
+	return hrp, data, err
+}
+
+func decodeKey(s, prefix string) ([]byte, error) {
+	hrp, key, err := bech32Decode(s)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(hrp, prefix) {
+		return nil, fmt.Errorf("key doesn't start with %s", prefix)
+	}
+	if len(key) != curve25519.ScalarSize {
+		return nil, errors.New("invalid key length")
+	}
+	return key, nil
+}
+
+// parseRecipient decodes a public key in the age1... form
+func parseRecipient(s string) ([]byte, error) {
+	return decodeKey(s, recipientPrefix)
+}
+
+// readIdentities reads the secret keys from a file, one per line, skipping comments
+func readIdentities(file string) ([][]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var identities [][]byte
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, err := decodeKey(line, identityPrefix)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		identities = append(identities, key)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(identities) == 0 {
+		return nil, fmt.Errorf("%s: no identities found", file)
+	}
+
+	return identities, nil
+}
+
+// keygen prints a new secret key, and its public key as a comment
+func keygen(w io.Writer) error {
+	identity := make([]byte, curve25519.ScalarSize)
+	_, err := rand.Read(identity)
+	if err != nil {
+		return err
+	}
+
+	recipient, err := curve25519.X25519(identity, curve25519.Basepoint)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "# public key: %s\n%s\n", bech32Encode(recipientPrefix, recipient),
+		strings.ToUpper(bech32Encode(strings.ToLower(identityPrefix), identity)))
+	return err
+}
+
+func deriveKey(secret, salt []byte, info string) []byte {
+	key := make([]byte, chacha20poly1305.KeySize)
+	io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), key)
+	return key
+}
+
+// wrapKey encrypts the file key with a key encryption key, the nonce can be zero as the key is used once
+func wrapKey(kek, fileKey []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(kek)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nil, make([]byte, chacha20poly1305.NonceSize), fileKey, nil), nil
+}
+
+func unwrapKey(kek, wrapped []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(kek)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, make([]byte, chacha20poly1305.NonceSize), wrapped, nil)
+}
+
+func x25519Kek(shared, ephemeral, recipient []byte) []byte {
+	return deriveKey(shared, append(append([]byte{}, ephemeral...), recipient...), "car X25519")
+}
+
+func scryptKek(passphrase, salt []byte, logN uint8) ([]byte, error) {
+	return scrypt.Key(passphrase, append([]byte("car scrypt"), salt...), 1<<logN, 8, 1, chacha20poly1305.KeySize)
+}
+
+/* encryptionHeader generates a new file key and returns it wrapped for every recipient
+ * and for the passphrase, in a list of stanzas:
+ * X25519: uint8 type, 32 bytes ephemeral public key, 48 bytes wrapped key
+ * scrypt: uint8 type, 16 bytes salt, uint8 log2 of the work factor, 48 bytes wrapped key */
+func (c *car) encryptionHeader() ([]byte, error) {
+	fileKey := make([]byte, fileKeySize)
+	_, err := rand.Read(fileKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var header bytes.Buffer
+
+	for _, recipient := range c.recipients {
+		ephemeral := make([]byte, curve25519.ScalarSize)
+		_, err = rand.Read(ephemeral)
+		if err != nil {
+			return nil, err
+		}
+
+		ephemeralPub, err := curve25519.X25519(ephemeral, curve25519.Basepoint)
+		if err != nil {
+			return nil, err
+		}
+
+		shared, err := curve25519.X25519(ephemeral, recipient)
+		if err != nil {
+			return nil, err
+		}
+
+		wrapped, err := wrapKey(x25519Kek(shared, ephemeralPub, recipient), fileKey)
+		if err != nil {
+			return nil, err
+		}
+
+		header.WriteByte(stanzaX25519)
+		header.Write(ephemeralPub)
+		header.Write(wrapped)
+	}
+
+	if c.passphrase != nil {
+		salt := make([]byte, 16)
+		_, err = rand.Read(salt)
+		if err != nil {
+			return nil, err
+		}
+
+		kek, err := scryptKek(c.passphrase, salt, scryptLogN)
+		if err != nil {
+			return nil, err
+		}
+
+		wrapped, err := wrapKey(kek, fileKey)
+		if err != nil {
+			return nil, err
+		}
+
+		header.WriteByte(stanzaScrypt)
+		header.Write(salt)
+		header.WriteByte(scryptLogN)
+		header.Write(wrapped)
+	}
+
+	c.payloadKey = deriveKey(fileKey, nil, "car payload")
+
+	return header.Bytes(), nil
+}
+
+// parseEncryptionHeader unwraps the file key with the first identity or passphrase which matches
+func (c *car) parseEncryptionHeader(header []byte) error {
+	for len(header) > 0 {
+		var fileKey []byte
+
+		switch header[0] {
+		case stanzaX25519:
+			const size = 1 + curve25519.PointSize + wrappedKeySize
+			if len(header) < size {
+				return errors.New("truncated encryption header")
+			}
+			ephemeral := header[1 : 1+curve25519.PointSize]
+			wrapped := header[1+curve25519.PointSize : size]
+			header = header[size:]
+
+			for _, identity := range c.identities {
+				shared, err := curve25519.X25519(identity, ephemeral)
+				if err != nil {
+					continue
+				}
+				recipient, err := curve25519.X25519(identity, curve25519.Basepoint)
+				if err != nil {
+					continue
+				}
+				fileKey, err = unwrapKey(x25519Kek(shared, ephemeral, recipient), wrapped)
+				if err == nil {
+					break
+				}
+			}
+		case stanzaScrypt:
+			const size = 1 + 16 + 1 + wrappedKeySize
+			if len(header) < size {
+				return errors.New("truncated encryption header")
+			}
+			salt := header[1:17]
+			logN := header[17]
+			wrapped := header[18:size]
+			header = header[size:]
+
+			if c.passphrase == nil {
+				continue
+			}
+			if logN > maxScryptLogN {
+				return fmt.Errorf("scrypt work factor too high: %d", logN)
+			}
+
+			kek, err := scryptKek(c.passphrase, salt, logN)
+			if err != nil {
+				return err
+			}
+			fileKey, _ = unwrapKey(kek, wrapped)
+		default:
+			return fmt.Errorf("unknown key stanza: %d", header[0])
+		}
+
+		if fileKey != nil {
+			c.payloadKey = deriveKey(fileKey, nil, "car payload")
+			return nil
+		}
+	}
+
+	return errors.New("no identity or passphrase matches the archive")
+}
+
+// encryptedSize returns the size of the data once encrypted, with an authentication tag per chunk
+func encryptedSize(size uint64) uint64 {
+	return size + (size+chunkSize-1)/chunkSize*chacha20poly1305.Overhead
+}
+
+// decryptedSize returns the size of the data once the authentication tags are removed
+func decryptedSize(size uint64) uint64 {
+	const chunk = chunkSize + chacha20poly1305.Overhead
+
+	tags := (size + chunk - 1) / chunk * chacha20poly1305.Overhead
+	if tags > size {
+		return 0
+	}
+	return size - tags
+}
+
+func chunkNonce(nonce []byte, counter uint64, last bool) {
+	binary.BigEndian.PutUint64(nonce[noncePrefixSize:], counter<<8)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+}
+
+/* chunkWriter encrypts the data in chunks, the last one is flagged so truncation is detected.
+ * The name of the entry is authenticated with every chunk, so the data of an entry can't
+ * be moved to another one */
+type chunkWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	nonce   []byte
+	ad      []byte
+	counter uint64
+	buf     []byte
+}
+
+func newChunkWriter(w io.Writer, key, prefix []byte, name string) (*chunkWriter, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	copy(nonce, prefix)
+
+	return &chunkWriter{
+		w:     w,
+		aead:  aead,
+		nonce: nonce,
+		ad:    []byte(name),
+		buf:   make([]byte, 0, chunkSize+chacha20poly1305.Overhead),
+	}, nil
+}
+
+func (cw *chunkWriter) seal(last bool) error {
+	chunkNonce(cw.nonce, cw.counter, last)
+	cw.counter++
+
+	_, err := cw.w.Write(cw.aead.Seal(cw.buf[:0], cw.nonce, cw.buf, cw.ad))
+	cw.buf = cw.buf[:0]
+
+	return err
+}
+
+func (cw *chunkWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// A chunk is sealed only when more data arrives, as we don't know yet if it's the last one
+		if len(cw.buf) == chunkSize {
+			if err := cw.seal(false); err != nil {
+				return written, err
+			}
+		}
+
+		n := min(chunkSize-len(cw.buf), len(p))
+		cw.buf = append(cw.buf, p[:n]...)
+		p = p[n:]
+		written += n
+	}
+
+	return written, nil
+}
+
+func (cw *chunkWriter) Close() error {
+	return cw.seal(true)
+}
+
+// chunkReader decrypts the data written by chunkWriter, size is the encrypted size
+type chunkReader struct {
+	r         io.Reader
+	aead      cipher.AEAD
+	nonce     []byte
+	ad        []byte
+	counter   uint64
+	remaining uint64
+	buf       []byte
+	plain     []byte
+}
+
+func newChunkReader(r io.Reader, key, prefix []byte, name string, size uint64) (*chunkReader, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	copy(nonce, prefix)
+
+	return &chunkReader{
+		r:         r,
+		aead:      aead,
+		nonce:     nonce,
+		ad:        []byte(name),
+		remaining: size,
+		buf:       make([]byte, chunkSize+chacha20poly1305.Overhead),
+	}, nil
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	if len(cr.plain) == 0 {
+		if cr.remaining == 0 {
+			return 0, io.EOF
+		}
+
+		n := min(uint64(len(cr.buf)), cr.remaining)
+		_, err := io.ReadFull(cr.r, cr.buf[:n])
+		if err != nil {
+			return 0, err
+		}
+		cr.remaining -= n
+
+		chunkNonce(cr.nonce, cr.counter, cr.remaining == 0)
+		cr.counter++
+
+		cr.plain, err = cr.aead.Open(cr.buf[:0], cr.nonce, cr.buf[:n], cr.ad)
+		if err != nil {
+			return 0, errors.New("encrypted data is corrupted or tampered")
+		}
+	}
+
+	n := copy(p, cr.plain)
+	cr.plain = cr.plain[n:]
+
+	return n, nil
+}
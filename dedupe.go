@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// How an existing file with the same content was kept, printed in verbose mode
+const (
+	methodDedupe    = "dedupe"
+	methodUnchanged = "unchanged"
+)
+
+// sameContent tells if the file has the same content as the data of the entry in the archive
+func sameContent(f *os.File, archive *os.File, e entry) (bool, error) {
+	stored := io.NewSectionReader(archive, e.offset, int64(e.size))
+	bufA := make([]byte, 64*1024)
+	bufB := make([]byte, len(bufA))
+
+	for off := int64(0); off < int64(e.size); {
+		n, err := io.ReadFull(stored, bufA)
+		if err == io.ErrUnexpectedEOF {
+			err = nil
+		}
+		if err != nil {
+			return false, err
+		}
+
+		_, err = f.ReadAt(bufB[:n], off)
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+
+		if !bytes.Equal(bufA[:n], bufB[:n]) {
+			return false, nil
+		}
+		off += int64(n)
+	}
+
+	return true, nil
+}
+
+/* keepExisting is used by --dedupe-existing: when a regular file with the same content as the entry
+ * is in the way, it's kept instead of being replaced, so it keeps its inode and hard links. Its extents
+ * are shared with the archive, where supported, and only its metadata is updated.
+ * It returns false if the file must be extracted as usual */
+func (c *car) keepExisting(archive *os.File, parent int, name string, e entry) (bool, error) {
+	var st unix.Stat_t
+	err := unix.Fstatat(parent, name, &st, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil || st.Mode&unix.S_IFMT != unix.S_IFREG || uint64(st.Size) != e.size {
+		return false, nil
+	}
+
+	// Read only is enough to dedupe a file which we own
+	fd, err := unix.Openat(parent, name, unix.O_RDONLY|unix.O_NOFOLLOW|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return false, nil
+	}
+	f := os.NewFile(uintptr(fd), name)
+	defer f.Close()
+
+	same, err := sameContent(f, archive, e)
+	if err != nil || !same {
+		return false, err
+	}
+
+	// The content is already there, sharing it is an optimization
+	method := methodUnchanged
+	if e.size > 0 {
+		// Even if it fails, a part of the file could be shared already
+		deduped, err := dedupeRange(archive, f, e.offset, e.size)
+		if err == nil && deduped == e.size {
+			method = methodDedupe
+		}
+		c.reflinked.Add(deduped)
+	}
+
+	// The existing file can have different permissions
+	err = unix.Fchmod(fd, e.Mode&0o7777)
+	if err != nil {
+		return true, err
+	}
+	err = c.setMetadata(e,
+		func(uid, gid int) error { return unix.Fchown(fd, uid, gid) },
+		func(mode uint32) error { return unix.Fchmod(fd, mode) },
+		func(mtime int64) error { return touchAt(parent, name, mtime) })
+
+	if c.verbose {
+		fmt.Printf("%s (%s)\n", e.name, method)
+	}
+
+	return true, err
+}
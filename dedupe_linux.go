@@ -0,0 +1,46 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+/* dedupeRange shares the extents of dst with a range of src, if they have the same content,
+ * and returns the number of bytes shared. The kernel can dedupe less than asked in a call,
+ * so it's called again until the whole range is done */
+func dedupeRange(src *os.File, dst *os.File, srcOffset int64, length uint64) (uint64, error) {
+	var done uint64
+	for done < length {
+		dedupe := unix.FileDedupeRange{
+			Src_offset: uint64(srcOffset) + done,
+			Src_length: length - done,
+			Info: []unix.FileDedupeRangeInfo{{
+				Dest_fd:     int64(dst.Fd()),
+				Dest_offset: done,
+			}},
+		}
+
+		err := unix.IoctlFileDedupeRange(int(src.Fd()), &dedupe)
+		if err != nil {
+			return done, err
+		}
+
+		switch status := dedupe.Info[0].Status; {
+		case status == unix.FILE_DEDUPE_RANGE_DIFFERS:
+			return done, errors.New("content differs")
+		case status < 0:
+			return done, unix.Errno(-status)
+		}
+
+		if dedupe.Info[0].Bytes_deduped == 0 {
+			break
+		}
+		done += dedupe.Info[0].Bytes_deduped
+	}
+
+	return done, nil
+}
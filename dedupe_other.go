@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+func dedupeRange(*os.File, *os.File, int64, uint64) (uint64, error) {
+	return 0, unix.EOPNOTSUPP
+}
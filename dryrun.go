@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Actions reported by --dry-run
+const (
+	actionCreate  = "create"
+	actionReplace = "replace"
+	actionMerge   = "merge"
+	actionSkip    = "skip"
+	actionFail    = "fail"
+)
+
+// dirEmpty tells if a directory has no entries
+func dirEmpty(parent int, name string) (bool, error) {
+	fd, err := unix.Openat(parent, name, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return false, err
+	}
+
+	dir := os.NewFile(uintptr(fd), name)
+	defer dir.Close()
+
+	names, err := dir.Readdirnames(1)
+	if err != nil && len(names) == 0 {
+		return true, nil
+	}
+
+	return false, err
+}
+
+// plannedName is the key of c.planned for an entry name
+func plannedName(name string) string {
+	return filepath.Clean(strings.TrimRight(name, "/"))
+}
+
+/* planEntry does the same checks as extractEntry, and returns what would be done and why.
+ * The entries which would be created by the previous ones are tracked in c.planned,
+ * as they don't exist in the filesystem */
+func (c *car) planEntry(e entry) (string, error) {
+	if e.nonce != nil && c.payloadKey == nil {
+		return actionFail, errors.New("entry is encrypted, an identity or a passphrase is needed")
+	}
+
+	switch e.Mode & unix.S_IFMT {
+	case unix.S_IFREG, unix.S_IFDIR, unix.S_IFLNK, unix.S_IFIFO:
+	case unix.S_IFBLK, unix.S_IFCHR:
+		if !c.superUser {
+			return actionFail, unix.EPERM
+		}
+	default:
+		return actionFail, fmt.Errorf("unsupported file type 0%o", e.Mode&unix.S_IFMT)
+	}
+
+	clean := plannedName(e.name)
+	planned, exists := c.planned[clean]
+
+	parent, name, err := c.openParent(e.name)
+	if err == nil && name == "." && e.Mode&unix.S_IFMT != unix.S_IFDIR {
+		unix.Close(parent)
+		err = unix.EXDEV
+	}
+	if err == unix.EXDEV || err == unix.ELOOP {
+		return actionSkip, errors.New("outside target directory")
+	}
+	if err == unix.ENOENT || err == unix.ENOTDIR {
+		// The parent directory would be created by a previous entry
+		if c.planned[filepath.Dir(clean)] != unix.S_IFDIR {
+			return actionFail, err
+		}
+		if !exists {
+			return actionCreate, nil
+		}
+		if planned == unix.S_IFDIR && e.Mode&unix.S_IFMT == unix.S_IFDIR {
+			return actionMerge, nil
+		}
+		return actionReplace, nil
+	}
+	if err != nil {
+		return actionFail, err
+	}
+	defer unix.Close(parent)
+
+	err = unix.Faccessat(parent, ".", unix.W_OK|unix.X_OK, unix.AT_EACCESS)
+	if err != nil {
+		return actionFail, err
+	}
+
+	var st unix.Stat_t
+	err = unix.Fstatat(parent, name, &st, unix.AT_SYMLINK_NOFOLLOW)
+	if err == unix.ENOENT {
+		if exists {
+			return actionReplace, nil
+		}
+		return actionCreate, nil
+	}
+	if err != nil {
+		return actionFail, err
+	}
+
+	isDir := st.Mode&unix.S_IFMT == unix.S_IFDIR
+	if isDir && e.Mode&unix.S_IFMT == unix.S_IFDIR {
+		return actionMerge, nil
+	}
+
+	switch c.overwrite {
+	case overwriteKeepOld:
+		return actionFail, unix.EEXIST
+	case overwriteSkipOld:
+		return actionSkip, errors.New("already exists")
+	case overwriteKeepNewer:
+		if st.Mtim.Nano() > e.Mtime {
+			return actionSkip, errors.New("existing file is newer")
+		}
+	}
+
+	// Only empty directories can be replaced without --recursive-unlink
+	if isDir && !c.recursiveUnlink {
+		empty, err := dirEmpty(parent, name)
+		if err != nil {
+			return actionFail, err
+		}
+		if !empty {
+			return actionFail, unix.ENOTEMPTY
+		}
+	}
+
+	return actionReplace, nil
+}
+
+// printPlan prints what extracting the entry would do, without touching the filesystem
+func (c *car) printPlan(e entry) {
+	action, err := c.planEntry(e)
+
+	if action != actionSkip && action != actionFail {
+		c.planned[plannedName(e.name)] = e.Mode & unix.S_IFMT
+	}
+
+	switch {
+	case action == actionFail:
+		c.setError()
+		fmt.Printf("%-7s %s: %v\n", action, e.name, err)
+	case err != nil:
+		fmt.Printf("%-7s %s (%v)\n", action, e.name, err)
+	default:
+		fmt.Printf("%-7s %s\n", action, e.name)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+const (
+	encodingNone uint16 = iota
+	encodingZstd
+	encodingGzip
+	encodingXz
+)
+
+var encodingNames = map[uint16]string{
+	encodingNone: "none",
+	encodingZstd: "zstd",
+	encodingGzip: "gzip",
+	encodingXz:   "xz",
+}
+
+// Magic numbers of the compressed streams
+var encodingMagics = map[uint16][]byte{
+	encodingZstd: {0x28, 0xb5, 0x2f, 0xfd},
+	encodingGzip: {0x1f, 0x8b},
+	encodingXz:   {0xfd, '7', 'z', 'X', 'Z', 0x00},
+}
+
+// The longest magic number
+const magicSize = 6
+
+func detectEncoding(buf []byte) uint16 {
+	for enc, magic := range encodingMagics {
+		if bytes.HasPrefix(buf, magic) {
+			return enc
+		}
+	}
+
+	return encodingNone
+}
+
+func parseEncoding(name string) (uint16, error) {
+	for enc, n := range encodingNames {
+		if n == name {
+			return enc, nil
+		}
+	}
+
+	return 0, errors.New("unknown encoding: " + name)
+}
+
+func newEncoder(encoding uint16, w io.Writer) (io.WriteCloser, error) {
+	switch encoding {
+	case encodingZstd:
+		return zstd.NewWriter(w)
+	case encodingGzip:
+		return gzip.NewWriter(w), nil
+	case encodingXz:
+		return xz.NewWriter(w)
+	}
+
+	return nil, errors.New("unknown encoding")
+}
+
+func newDecoder(encoding uint16, r io.Reader) (io.ReadCloser, error) {
+	switch encoding {
+	case encodingZstd:
+		dec, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return dec.IOReadCloser(), nil
+	case encodingGzip:
+		return gzip.NewReader(r)
+	case encodingXz:
+		dec, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(dec), nil
+	}
+
+	return nil, errors.New("unknown encoding")
+}
+
+// readPipe feeds the data read from r into a pipe, so it can be used as a non seekable archive.
+// r is closed when done, if it's an io.Closer
+func readPipe(r io.Reader) (*os.File, <-chan error, error) {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(pw, r)
+		pw.Close()
+		if closer, ok := r.(io.Closer); ok {
+			closer.Close()
+		}
+		errc <- err
+	}()
+
+	return pr, errc, nil
+}
+
+// writePipe returns a pipe whose content is compressed into out, the pipe must be closed when done
+func writePipe(encoding uint16, out io.Writer) (*os.File, <-chan error, error) {
+	enc, err := newEncoder(encoding, out)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(enc, pr)
+		pr.Close()
+		if cerr := enc.Close(); err == nil {
+			err = cerr
+		}
+		errc <- err
+	}()
+
+	return pw, errc, nil
+}
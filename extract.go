@@ -1,14 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"crypto/ed25519"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
-	"io/fs"
 	"os"
 	"os/user"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"syscall"
@@ -112,105 +112,402 @@ func verbosePrint(e entry) {
 		gid = group.Name
 	}
 
+	if e.encoding != encodingNone || e.nonce != nil {
+		var details []string
+		if e.encoding != encodingNone {
+			details = append(details, encodingNames[e.encoding])
+		}
+		if e.nonce != nil {
+			details = append(details, "encrypted")
+		}
+		details = append(details, strings.TrimSpace(prettySize(e.stored))+" stored")
+		link += " (" + strings.Join(details, ", ") + ")"
+	}
+
 	fmt.Printf("%s %12s %12s %s %s %s%s\n", perm, uid, gid, size, mtime, e.name, link)
 }
 
-func (c *car) extractFile(archive *os.File, e entry, mode fs.FileMode) error {
-	f, err := os.OpenFile(e.name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+/* extractFile writes the file in a temporary file, and moves it in place only when complete and with
+ * its metadata set, so that a crash or a reader of the directory never see a partially extracted file */
+func (c *car) extractFile(archive *os.File, e entry, parent int, name string, mode uint32) error {
+	f, tmp, err := createTemp(parent, e.name, mode)
 	if err != nil {
+		if skipErr := c.safeRSeek(archive, int64(e.payload())); skipErr != nil {
+			return skipErr
+		}
 		return err
 	}
+
+	if c.tasks != nil && e.size > 0 {
+		err = c.writeAsync(archive, f, e, parent, name, tmp)
+		if err == nil {
+			return nil
+		}
+		if tmp != "" {
+			unix.Unlinkat(parent, tmp, 0)
+		}
+		f.Close()
+		return err
+	}
+
 	defer f.Close()
 
+	return c.finishFile(archive, f, e, parent, name, tmp)
+}
+
+// finishFile writes the data and the metadata of the file, and moves it in place
+func (c *car) finishFile(archive *os.File, f *os.File, e entry, parent int, name, tmp string) error {
+	var metaErr error
+	method, err := c.writeFile(archive, f, e)
+	if err == nil && tmp == "" {
+		tmp, err = linkTemp(f, parent)
+	}
+	if err == nil {
+		fd := int(f.Fd())
+		metaErr = c.setMetadata(e,
+			func(uid, gid int) error { return unix.Fchown(fd, uid, gid) },
+			func(mode uint32) error { return unix.Fchmod(fd, mode) },
+			func(mtime int64) error { return touchAt(parent, tmp, mtime) })
+	}
+	if err == nil {
+		// rename() replaces any file, but not a directory
+		err = c.replaceAt(parent, name, func() error {
+			return unix.Renameat(parent, tmp, parent, name)
+		})
+	}
+	if err != nil {
+		if tmp != "" {
+			unix.Unlinkat(parent, tmp, 0)
+		}
+		return err
+	}
+
+	if c.verbose {
+		if method != "" {
+			fmt.Printf("%s (%s)\n", e.name, method)
+		} else {
+			fmt.Println(e.name)
+		}
+	}
+
+	return metaErr
+}
+
+/* writeFile writes the data of the entry into the file, from its offset in the archive if seekable.
+ * It returns how the data was copied, if not decoded */
+func (c *car) writeFile(archive *os.File, f *os.File, e entry) (string, error) {
 	if e.size == 0 {
-		return nil
+		return "", nil
+	}
+
+	plain := e.encoding == encodingNone && e.nonce == nil
+
+	if !plain && c.requireReflink {
+		return "", errors.New("compressed or encrypted data can't be reflinked")
+	}
+
+	// Only the data which can't be reflinked takes space
+	if !plain || !c.seekable {
+		err := allocate(f, 0, int64(e.size))
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if !c.seekable {
+		// Deduplicated entry, the data is stored by a previous one
+		if e.ref != 0 {
+			return "", errors.New("deduplicated data needs a seekable archive")
+		}
+		if plain {
+			method, err := copyContent(f, archive, -1, int64(e.size))
+			if err == nil {
+				c.countData(method, e.size)
+			}
+			return method, err
+		}
+	} else if plain {
+		return c.copyFromArchive(archive, f, e)
+	}
+
+	var data io.Reader = io.LimitReader(archive, int64(e.stored))
+	if c.seekable {
+		data = io.NewSectionReader(archive, e.offset, int64(e.stored))
 	}
 
-	err = reflinkFromArchive(archive, f, e.size)
+	err := c.copyData(data, f, e)
+	if err == nil {
+		c.countData(methodCopy, e.size)
+	}
+
+	return "", err
+}
+
+// copyData writes the stored data into the file, decoding it
+func (c *car) copyData(data io.Reader, f *os.File, e entry) error {
+	r := data
+
+	if e.nonce != nil {
+		cr, err := newChunkReader(data, c.payloadKey, e.nonce, e.owner, e.stored)
+		if err != nil {
+			return err
+		}
+		r = cr
+	}
+
+	if e.encoding != encodingNone {
+		dec, err := newDecoder(e.encoding, r)
+		if err != nil {
+			return err
+		}
+		defer dec.Close()
+		r = dec
+	}
+
+	// Never write more than the declared size
+	n, err := io.CopyN(f, r, int64(e.size))
+	if err == io.EOF {
+		return fmt.Errorf("decoded %d bytes instead of %d", n, e.size)
+	}
+	if err != nil {
+		return err
+	}
+	if n, _ := r.Read(make([]byte, 1)); n > 0 {
+		return fmt.Errorf("decoded data longer than %d bytes", e.size)
+	}
+
+	// Skip any trailing data not consumed by the decoder
+	_, err = io.Copy(io.Discard, data)
+
+	return err
+}
+
+// copyFromArchive reflinks the data of the entry into the file, or copies it if reflink isn't possible
+func (c *car) copyFromArchive(archive *os.File, f *os.File, e entry) (string, error) {
+	method := methodReflink
+	err := reflinkError
+	if !c.noReflink {
+		err = reflinkFromArchive(archive, f, e.offset, e.size, c.alignment)
+	}
 	if err != nil && errors.Is(err, reflinkError) {
-		_, err = io.CopyN(f, archive, int64(e.size))
+		if c.requireReflink {
+			return "", reflinkRequired(err)
+		}
+		err = allocate(f, 0, int64(e.size))
+		if err != nil {
+			return "", err
+		}
+		method, err = copyContent(f, archive, e.offset, int64(e.size))
 	}
+	if err != nil {
+		return "", err
+	}
+
+	c.countData(method, e.size)
+
+	return method, nil
+}
+
+/* openParent opens the directory containing the entry, which must be below the destination directory.
+ * The entry "." stored by car -c . is the destination directory itself, returned as "." in it */
+func (c *car) openParent(name string) (int, string, error) {
+	name = strings.TrimRight(name, "/")
+	if name == "." {
+		fd, err := unix.FcntlInt(uintptr(c.destFd), unix.F_DUPFD_CLOEXEC, 0)
+		return fd, name, err
+	}
+
+	dir, base := ".", name
+	if i := strings.LastIndexByte(name, '/'); i >= 0 {
+		dir, base = name[:i], name[i+1:]
+		if dir == "" {
+			dir = "/"
+		}
+	}
+
+	if base == "" || base == "." || base == ".." {
+		return -1, "", unix.EXDEV
+	}
+
+	fd, err := openBeneath(c.destFd, dir)
 
+	return fd, base, err
+}
+
+// removeAt removes a file or an empty directory, like os.Remove()
+func removeAt(parent int, name string) error {
+	err := unix.Unlinkat(parent, name, 0)
+	if err == unix.EISDIR || err == unix.EPERM {
+		if rmerr := unix.Unlinkat(parent, name, unix.AT_REMOVEDIR); rmerr != unix.ENOTDIR {
+			err = rmerr
+		}
+	}
 	return err
 }
 
-func (c *car) extractEntry(archive *os.File, e entry) error {
-	var err, reterr error
+// mkdirAt creates a directory, an existing one is kept, while anything else is replaced
+func mkdirAt(parent int, name string, mode uint32) error {
+	err := unix.Mkdirat(parent, name, mode)
+	if err != unix.EEXIST {
+		return err
+	}
 
-	realPath, err := filepath.EvalSymlinks(filepath.Dir(c.destDir + "/" + e.name))
+	var st unix.Stat_t
+	err = unix.Fstatat(parent, name, &st, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil || st.Mode&unix.S_IFMT == unix.S_IFDIR {
+		return err
+	}
+
+	err = removeAt(parent, name)
 	if err != nil {
 		return err
 	}
 
-	if !strings.HasPrefix(realPath, c.destDir) {
-		fmt.Fprintf(os.Stderr, "skipping '%s' because its real path '%s' is outside target directory\n", e.name, realPath)
-		return c.safeRSeek(archive, int64(e.size))
+	return unix.Mkdirat(parent, name, mode)
+}
+
+func (c *car) extractEntry(archive *os.File, e entry) error {
+	var err error
+
+	if e.nonce != nil && c.payloadKey == nil {
+		err = c.safeRSeek(archive, int64(e.payload()))
+		if err != nil {
+			return err
+		}
+		return errors.New("entry is encrypted, an identity or a passphrase is needed")
+	}
+
+	// A file with the same name could still be written by a worker
+	if c.tasks != nil {
+		c.waitPending(e.name)
+	}
+
+	/* All the operations are relative to the parent directory, which is resolved by the kernel
+	 * so that neither "..", absolute paths or symlinks created by previous entries can escape
+	 * the destination directory */
+	parent, name, err := c.openParent(e.name)
+	if err == nil && name == "." && e.Mode&unix.S_IFMT != unix.S_IFDIR {
+		// Only a directory can be merged with the destination directory
+		unix.Close(parent)
+		err = unix.EXDEV
 	}
+	if err != nil {
+		if skipErr := c.safeRSeek(archive, int64(e.payload())); skipErr != nil {
+			return skipErr
+		}
+		if err == unix.EXDEV || err == unix.ELOOP {
+			fmt.Fprintf(os.Stderr, "skipping '%s' because it's outside target directory\n", e.name)
+			return nil
+		}
+		return err
+	}
+	defer unix.Close(parent)
 
-	mode := uint32(e.Mode & 0o777)
-	fsFileMode := fs.FileMode(mode)
+	mode := e.Mode & 0o777
+	deferred := false
 
-	// File could already exist and have no write permission, delete it
-	if e.Mode&unix.S_IFMT != unix.S_IFDIR {
-		os.Remove(e.name)
+	// An identical file is kept only when it would be replaced
+	if c.dedupeExisting && c.overwrite == overwriteReplace && e.Mode&unix.S_IFMT == unix.S_IFREG &&
+		e.encoding == encodingNone && e.nonce == nil {
+		kept, err := c.keepExisting(archive, parent, name, e)
+		if kept || err != nil {
+			return err
+		}
+	}
+
+	ok, err := c.checkExisting(parent, name, e)
+	if err != nil || !ok {
+		if skipErr := c.safeRSeek(archive, int64(e.payload())); skipErr != nil {
+			return skipErr
+		}
+		return err
 	}
 
 	switch e.Mode & unix.S_IFMT {
 	case unix.S_IFREG:
-		err = c.extractFile(archive, e, fsFileMode)
+		err = c.extractFile(archive, e, parent, name, mode)
 	case unix.S_IFDIR:
-		modeSet := fs.FileMode(e.Mode & 0o7777)
-		if modeSet&0o300 != 0o300 {
+		if mode&0o300 != 0o300 {
 			/* A directory can have no write or execute permissions, yet contain files. To correctly
 			 * extract files inside, set permissions to 0300 now and defer the real permission set. */
-			c.dirModes = append(c.dirModes, dirMode{e.name, modeSet})
-			modeSet = 0o300
+			c.dirModes = append(c.dirModes, dirMode{e.name, e.Mode & 0o7777})
+			mode |= 0o300
+			deferred = true
 		}
-		/* os.MkdirAll() never returns error on exist. If directory
-		 * already exists, ignore it and just change permission later */
-		err = os.Mkdir(e.name, fsFileMode|modeSet)
-		if errors.Is(err, os.ErrExist) {
-			err = nil
+		/* If directory already exists, ignore it and just change permission later */
+		err = mkdirAt(parent, name, mode)
+		if err == nil {
+			c.dirTimes = append(c.dirTimes, dirTime{e.name, e.Mtime})
 		}
 	case unix.S_IFLNK:
-		err = os.Symlink(e.link, e.name)
+		err = c.replaceAt(parent, name, func() error {
+			return unix.Symlinkat(e.link, parent, name)
+		})
 	case unix.S_IFBLK, unix.S_IFCHR:
-		err = syscall.Mknod(e.name, e.Mode, int(e.dev))
+		err = c.replaceAt(parent, name, func() error {
+			return mknodAt(parent, name, e.Mode, int(e.dev))
+		})
 	case unix.S_IFIFO:
-		err = syscall.Mkfifo(e.name, mode)
+		err = c.replaceAt(parent, name, func() error {
+			return mknodAt(parent, name, unix.S_IFIFO|mode, 0)
+		})
+	default:
+		err = fmt.Errorf("unsupported file type 0%o", e.Mode&unix.S_IFMT)
 	}
 
-	if err != nil {
+	// Regular files already have their metadata, set before moving them in place
+	if err != nil || e.Mode&unix.S_IFMT == unix.S_IFREG {
 		return err
 	}
 
-	/* Errors past this point are not fatal, but will printed
+	/* chmod() follows symlinks, which can point outside the destination directory,
+	 * and the permissions of a symlink can't be changed anyway */
+	chmod := func(mode uint32) error { return unix.Fchmodat(parent, name, mode, 0) }
+	if deferred || e.Mode&unix.S_IFMT == unix.S_IFLNK {
+		chmod = nil
+	}
+
+	touch := func(mtime int64) error { return touchAt(parent, name, mtime) }
+	if e.Mode&unix.S_IFMT == unix.S_IFDIR {
+		touch = nil
+	}
+
+	return c.setMetadata(e, func(uid, gid int) error {
+		return unix.Fchownat(parent, name, uid, gid, unix.AT_SYMLINK_NOFOLLOW)
+	}, chmod, touch)
+}
+
+// touchAt sets the modification time of a file, or of a symlink itself, and the access time to now
+func touchAt(parent int, name string, mtime int64) error {
+	now := time.Now().UnixNano()
+	ts := []unix.Timespec{unix.NsecToTimespec(now), unix.NsecToTimespec(mtime)}
+	return unix.UtimesNanoAt(parent, name, ts, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+/* setMetadata sets the owner, the special permission bits and the modification time,
+ * chmod and touch are nil if the permissions or the time are set later */
+func (c *car) setMetadata(e entry, chown func(uid, gid int) error, chmod func(mode uint32) error,
+	touch func(mtime int64) error) error {
+	var reterr error
+
+	/* Errors here are not fatal, but will printed
 	 * on stderr and led to error exit status */
 
 	if c.superUser {
 		/* chmod() clears the SetUID bit and xattrs, so order is important */
-		err = os.Lchown(e.name, int(e.Uid), int(e.Gid))
+		err := chown(int(e.Uid), int(e.Gid))
 		if err != nil {
-			c.error = 1
+			c.setError()
 			fmt.Fprintf(os.Stderr, "can't set owner: %v\n", err)
 			/* Save the first error */
 			reterr = err
 		}
 	}
 
-	if e.Mode&0o7000 != 0 {
-		if e.Mode&unix.S_ISUID != 0 {
-			fsFileMode |= fs.ModeSetuid
-		}
-		if e.Mode&unix.S_ISGID != 0 {
-			fsFileMode |= fs.ModeSetgid
-		}
-		if e.Mode&unix.S_ISVTX != 0 {
-			fsFileMode |= fs.ModeSticky
-		}
-		err = os.Chmod(e.name, fsFileMode)
+	if e.Mode&0o7000 != 0 && chmod != nil {
+		err := chmod(e.Mode & 0o7777)
 		if err != nil {
-			c.error = 1
+			c.setError()
 			fmt.Fprintf(os.Stderr, "can't set permissions: %v\n", err)
 			if reterr == nil {
 				/* Having to choose, report only the first error */
@@ -219,20 +516,74 @@ func (c *car) extractEntry(archive *os.File, e entry) error {
 		}
 	}
 
+	if touch != nil {
+		err := touch(e.Mtime)
+		if err != nil {
+			c.setError()
+			fmt.Fprintf(os.Stderr, "can't set modification time: %v\n", err)
+			if reterr == nil {
+				reterr = err
+			}
+		}
+	}
+
 	return reterr
 }
 
-func (c *car) parseEntry(archive *os.File) (*entry, error) {
-	buf := make([]byte, 4)
+// checkLength validates the length of a fixed size tag
+func checkLength(t tag, size int) error {
+	if int(t.Length) != size {
+		return fmt.Errorf("bad length %d for tag 0x%x", t.Length, t.Tag)
+	}
+	return nil
+}
 
-	_, err := archive.Read(buf[:4])
+// checkBounds validates that some data at the given offset lies within the archive, if its size is known
+func (c *car) checkBounds(offset, size uint64) error {
+	if c.archiveSize > 0 && (offset > uint64(c.archiveSize) || size > uint64(c.archiveSize)-offset) {
+		return errors.New("data past the end of the archive")
+	}
+	return nil
+}
+
+// readString reads the value of a tag containing a string
+func readString(archive *os.File, t tag) (string, error) {
+	buf := make([]byte, t.Length)
+
+	_, err := io.ReadFull(archive, buf)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	if string(buf[:4]) == cowEnd {
+	if bytes.IndexByte(buf, 0) >= 0 {
+		return "", fmt.Errorf("NUL character in tag 0x%x", t.Tag)
+	}
+
+	return string(buf), nil
+}
+
+/* readEntry reads the header of the next entry, leaving the archive at the start of its data.
+ * On error, the entry returned has the fields read so far, if any */
+func (c *car) readEntry(archive *os.File) (*entry, error) {
+	buf := []byte(cowMagic)
+
+	// The magic of the first entry could be read already to detect the compression
+	if c.magicRead {
+		c.magicRead = false
+	} else {
+		_, err := io.ReadFull(archive, buf)
+		if err == io.EOF {
+			// The archive must end with cowEnd
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if string(buf) == cowEnd {
 		return nil, io.EOF
-	} else if string(buf[:4]) != cowMagic {
+	} else if string(buf) != cowMagic {
 		return nil, errors.New("bad entry")
 	}
 
@@ -244,87 +595,377 @@ tagLoop:
 
 		err := binary.Read(archive, binary.BigEndian, &tag)
 		if err != nil {
-			return nil, err
+			return &e, err
 		}
 
 		switch tag.Tag {
 		case tagHeader:
+			if err = checkLength(tag, binary.Size(e.fixedData)); err != nil {
+				return &e, err
+			}
 			err = binary.Read(archive, binary.BigEndian, &e.fixedData)
 			if err != nil {
-				return nil, err
+				return &e, err
 			}
+			e.hasHeader = true
 		case tagName:
-			buf := make([]byte, tag.Length)
-			_, err := archive.Read(buf)
+			e.name, err = readString(archive, tag)
 			if err != nil {
-				return nil, err
+				return &e, err
 			}
-			e.name = string(buf)
-
 		case tagLinkTarget:
-			buf := make([]byte, tag.Length)
-			_, err := archive.Read(buf)
+			e.link, err = readString(archive, tag)
 			if err != nil {
-				return nil, err
+				return &e, err
 			}
-			e.link = string(buf)
 		case tagDevice:
+			if err = checkLength(tag, binary.Size(e.dev)); err != nil {
+				return &e, err
+			}
 			err = binary.Read(archive, binary.BigEndian, &e.dev)
 			if err != nil {
-				return nil, err
+				return &e, err
+			}
+		case tagDataRef:
+			var ref dataRef
+			if err = checkLength(tag, binary.Size(ref)); err != nil {
+				return &e, err
+			}
+			err = binary.Read(archive, binary.BigEndian, &ref)
+			if err != nil {
+				return &e, err
+			}
+			if ref.Offset == 0 {
+				return &e, errors.New("bad data reference")
+			}
+			if err = c.checkBounds(ref.Offset, ref.Size); err != nil {
+				return &e, err
+			}
+			e.ref = ref.Offset
+			e.offset = int64(ref.Offset)
+			e.stored = ref.Size
+		case tagEncoding:
+			var ed encodedData
+			if err = checkLength(tag, binary.Size(ed)); err != nil {
+				return &e, err
+			}
+			err = binary.Read(archive, binary.BigEndian, &ed)
+			if err != nil {
+				return &e, err
+			}
+			if _, ok := encodingNames[ed.Encoding]; !ok || ed.Encoding == encodingNone {
+				return &e, fmt.Errorf("unknown encoding: %d", ed.Encoding)
+			}
+			e.encoding = ed.Encoding
+			e.size = ed.Size
+		case tagCipher:
+			if err = checkLength(tag, noncePrefixSize); err != nil {
+				return &e, err
+			}
+			e.nonce = make([]byte, noncePrefixSize)
+			_, err = io.ReadFull(archive, e.nonce)
+			if err != nil {
+				return &e, err
+			}
+		case tagEncryption:
+			e.encryption = make([]byte, tag.Length)
+			_, err = io.ReadFull(archive, e.encryption)
+			if err != nil {
+				return &e, err
+			}
+		case tagSignature:
+			if err = checkLength(tag, ed25519.SignatureSize); err != nil {
+				return &e, err
+			}
+			e.signature = make([]byte, ed25519.SignatureSize)
+			_, err = io.ReadFull(archive, e.signature)
+			if err != nil {
+				return &e, err
 			}
 		case tagData:
 			if tag.Length == 12 {
 				var pd paddedData
 				err = binary.Read(archive, binary.BigEndian, &pd)
 				if err != nil {
-					return nil, err
+					return &e, err
+				}
+				if uint64(pd.Padding) >= c.alignment {
+					return &e, errors.New("bad padding")
 				}
-				e.size = pd.Size
 				err = c.safeRSeek(archive, int64(pd.Padding))
 				if err != nil {
-					return nil, err
+					return &e, err
+				}
+				e.padding = pd.Padding
+				if e.ref != 0 {
+					return &e, errors.New("entry has both data and a data reference")
+				}
+				if c.seekable {
+					offset, err := archive.Seek(0, io.SeekCurrent)
+					if err != nil {
+						return &e, err
+					}
+					if err = c.checkBounds(uint64(offset), pd.Size); err != nil {
+						return &e, err
+					}
+					e.offset = offset
 				}
+				e.stored = pd.Size
 			} else if tag.Length != 0 {
-				return nil, errors.New("bad file size field width")
+				return &e, errors.New("bad file size field width")
 			}
 			break tagLoop
+		case tagFormat:
+			var fd formatData
+			if err = checkLength(tag, binary.Size(fd)); err != nil {
+				return &e, err
+			}
+			err = binary.Read(archive, binary.BigEndian, &fd)
+			if err != nil {
+				return &e, err
+			}
+			if fd.Version > formatVersion || fd.Features&^knownFeatures != 0 {
+				return &e, fmt.Errorf("archive format %d with features 0x%x not supported, a newer car is needed",
+					fd.Version, fd.Features)
+			}
+			e.format = &fd
+		case tagAlignment:
+			var alignment uint32
+			if err = checkLength(tag, binary.Size(alignment)); err != nil {
+				return &e, err
+			}
+			err = binary.Read(archive, binary.BigEndian, &alignment)
+			if err != nil {
+				return &e, err
+			}
+			// 1 means that the data isn't aligned
+			if alignment != 1 && validAlignment(uint64(alignment)) != uint64(alignment) {
+				return &e, fmt.Errorf("bad alignment %d", alignment)
+			}
+			// It applies to all the entries which follow
+			c.alignment = uint64(alignment)
 		default:
-			fmt.Fprintf(os.Stderr, "unknown tag: 0x%x\n", tag.Tag)
+			// Keep reading up to the data, so that the entry can be skipped
+			if tag.Tag&tagCritical != 0 && e.unsupported == 0 {
+				e.unsupported = tag.Tag
+			}
+			err = c.safeRSeek(archive, int64(tag.Length))
+			if err != nil {
+				return &e, err
+			}
+		}
+	}
+
+	if e.encoding == encodingNone {
+		e.size = e.stored
+		if e.nonce != nil {
+			e.size = decryptedSize(e.stored)
+		}
+	}
+
+	// Encrypted data is authenticated with the name of the entry which stored it
+	e.owner = e.name
+	if e.nonce != nil {
+		if c.dataNames == nil {
+			c.dataNames = make(map[uint64]string)
+		}
+		if e.ref != 0 {
+			e.owner = c.dataNames[e.ref]
+		} else if c.seekable {
+			c.dataNames[uint64(e.offset)] = e.name
 		}
 	}
 
+	// Only the records about the whole archive have neither header nor name
+	if e.archiveRecord() {
+		if e.payload() > 0 {
+			return &e, errors.New("data in an archive record")
+		}
+	} else {
+		if !e.hasHeader || e.name == "" {
+			return &e, errors.New("entry without header or name")
+		}
+		if e.stored > 0 && e.Mode&unix.S_IFMT != unix.S_IFREG {
+			return &e, fmt.Errorf("%s: data in a non regular file", e.name)
+		}
+	}
+
+	return &e, nil
+}
+
+func (c *car) parseEntry(archive *os.File) (*entry, error) {
+	e, err := c.readEntry(archive)
+	if err != nil {
+		return e, err
+	}
+
+	// Records without a name carry information about the whole archive
+	switch {
+	case e.archiveRecord() && e.unsupported != 0:
+		return nil, fmt.Errorf("unsupported critical tag 0x%x in the archive header", e.unsupported)
+	case e.encryption != nil:
+		// Without keys the archive can still be listed
+		if c.identities != nil || c.passphrase != nil {
+			err = c.parseEncryptionHeader(e.encryption)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return e, nil
+	case e.archiveRecord():
+		// Format already checked by readEntry, signature before starting if requested
+		return e, nil
+	}
+
+	if e.unsupported != 0 {
+		c.setError()
+		fmt.Fprintf(os.Stderr, "skipping %s: unsupported critical tag 0x%x\n", e.name, e.unsupported)
+		return e, c.safeRSeek(archive, int64(e.payload()))
+	}
+
 	if c.list && c.verbose {
-		verbosePrint(e)
-	} else if c.list || c.verbose {
+		verbosePrint(*e)
+	} else if c.list || (c.verbose && !c.dryRun && e.Mode&unix.S_IFMT != unix.S_IFREG) {
+		// Regular files are printed once extracted, with the copy method
 		fmt.Println(e.name)
 	}
 
-	if c.list {
-		if e.size > 0 {
-			err = c.safeRSeek(archive, int64(e.size))
+	if c.dryRun && !c.list {
+		c.printPlan(*e)
+	}
+
+	if c.list || c.dryRun {
+		if e.payload() > 0 {
+			err = c.safeRSeek(archive, int64(e.payload()))
 			if err != nil {
 				return nil, err
 			}
 		}
 	} else {
-		err = c.extractEntry(archive, e)
+		var end int64
+		if c.seekable {
+			end, err = archive.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return nil, err
+			}
+			end += int64(e.payload())
+		}
+
+		c.padded.Add(uint64(e.padding))
+
+		err = c.extractEntry(archive, *e)
 		if err != nil {
-			c.error = 1
+			c.setError()
 			fmt.Fprintf(os.Stderr, "cannot create %s: %v\n", e.name, err)
 		}
+
+		// Whatever happened, the next entry starts after the data
+		if c.seekable {
+			_, err = archive.Seek(end, io.SeekStart)
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
 
-	return &e, nil
+	return e, nil
+}
+
+// openStream detects if the archive is compressed, and returns a pipe with the decompressed data.
+// The bytes read from a non seekable archive can't be put back, so if it isn't compressed the magic
+// of the first entry is left for readEntry to skip, otherwise they are fed to the decompressor
+func (c *car) openStream(archive *os.File) (*os.File, <-chan error, error) {
+	magic := make([]byte, magicSize)
+	var r io.Reader = archive
+
+	if pos, err := archive.Seek(0, io.SeekCurrent); err == nil {
+		n, err := archive.ReadAt(magic, pos)
+		if err != nil && err != io.EOF {
+			return nil, nil, err
+		}
+		if detectEncoding(magic[:n]) == encodingNone {
+			return archive, nil, nil
+		}
+	} else {
+		n, err := io.ReadFull(archive, magic[:len(cowMagic)])
+		if err == nil && string(magic[:n]) == cowMagic {
+			c.magicRead = true
+			return archive, nil, nil
+		}
+		if err == nil {
+			var m int
+			m, err = io.ReadFull(archive, magic[n:])
+			n += m
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, nil, err
+		}
+		magic = magic[:n]
+		r = io.MultiReader(bytes.NewReader(magic), archive)
+	}
+
+	if encoding := detectEncoding(magic); encoding != encodingNone {
+		dec, err := newDecoder(encoding, r)
+		if err != nil {
+			return nil, nil, err
+		}
+		r = dec
+	}
+
+	return readPipe(r)
+}
+
+// closeStream waits for the end of the pipe feeding the archive,
+// and returns its error if any, otherwise the parsing one
+func closeStream(archive *os.File, stream <-chan error, err error) error {
+	if err == nil {
+		// Consume the padding after the last entry
+		_, err = io.Copy(io.Discard, archive)
+	}
+	archive.Close()
+
+	if serr := <-stream; serr != nil && !errors.Is(serr, syscall.EPIPE) {
+		return serr
+	}
+
+	return err
 }
 
+// deferredPermissions sets the permissions and the times of the directories, once all the files are in place
 func (c *car) deferredPermissions() error {
 	for i := len(c.dirModes) - 1; i >= 0; i-- {
-		err := os.Chmod(c.dirModes[i].name, c.dirModes[i].mode)
+		parent, name, err := c.openParent(c.dirModes[i].name)
+		if err != nil {
+			return err
+		}
+
+		// A later entry could have replaced the directory with a symlink, which chmod would follow
+		var st unix.Stat_t
+		err = unix.Fstatat(parent, name, &st, unix.AT_SYMLINK_NOFOLLOW)
+		if err == nil && st.Mode&unix.S_IFMT == unix.S_IFDIR {
+			err = unix.Fchmodat(parent, name, c.dirModes[i].mode, 0)
+		}
+		unix.Close(parent)
 		if err != nil {
 			return err
 		}
 	}
+
+	for _, dt := range c.dirTimes {
+		parent, name, err := c.openParent(dt.name)
+		if err != nil {
+			return err
+		}
+		err = touchAt(parent, name, dt.mtime)
+		unix.Close(parent)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -337,6 +978,9 @@ func (c *car) extract(file string) error {
 		c.superUser = true
 	}
 
+	// Archives without alignment in the header are aligned to 4k
+	c.alignment = cowAlignment
+
 	if file != "" {
 		archive, err = os.Open(file)
 		if err != nil {
@@ -352,28 +996,145 @@ func (c *car) extract(file string) error {
 		return err
 	}
 
-	c.destDir, err = filepath.EvalSymlinks(c.destDir)
+	c.destFd, err = unix.Open(c.destDir, dirOpenFlags, 0)
 	if err != nil {
 		return err
 	}
+	defer unix.Close(c.destFd)
 
 	_, err = archive.Seek(0, io.SeekCurrent)
 	if err == nil {
 		c.seekable = true
-	} else {
+	} else if !c.spool {
 		fmt.Fprintln(os.Stderr, "Warning: archive is not seekable")
 	}
 
+	var stream <-chan error
+	archive, stream, err = c.openStream(archive)
+	if err != nil {
+		return err
+	}
+	if stream != nil {
+		c.seekable = false
+	}
+
+	// Save the stream into a file, from which the data can be reflinked
+	if c.spool && !c.seekable {
+		archive, err = c.spoolArchive(archive, stream)
+		if err != nil {
+			return err
+		}
+		defer archive.Close()
+
+		c.seekable = true
+		stream = nil
+	}
+
+	if c.seekable {
+		if fi, err := archive.Stat(); err == nil && fi.Mode().IsRegular() {
+			c.archiveSize = fi.Size()
+		}
+	}
+
+	if c.requireReflink && !c.seekable && !c.list && !c.dryRun {
+		err = errors.New("reflink needs a seekable, uncompressed archive")
+		if stream != nil {
+			closeStream(archive, stream, err)
+		}
+		return err
+	}
+
+	// Looking for the next valid entry needs to read the archive back and forth
+	if c.recover && !c.seekable {
+		err = errors.New("--recover needs a seekable archive, use --spool")
+		if stream != nil {
+			closeStream(archive, stream, err)
+		}
+		return err
+	}
+
+	if c.progress.show {
+		c.startProgress(0, uint64(c.archiveSize))
+	}
+
+	if !c.list && !c.dryRun {
+		err = c.checkSpace(archive)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.dedupeExisting && !c.seekable {
+		fmt.Fprintln(os.Stderr, "Warning: comparing the existing files needs a seekable archive, use --spool")
+		c.dedupeExisting = false
+	}
+
+	if c.dryRun {
+		c.planned = make(map[string]uint32)
+	}
+
+	// Parallel extraction reads the data at explicit offsets, so it needs a seekable archive
+	if c.jobs > 1 && c.seekable && !c.list && !c.dryRun {
+		c.pending = make(map[string]bool)
+		c.startWorkers()
+		defer c.stopWorkers()
+	}
+
+	if c.verifyKey != nil {
+		err = c.verifySignature(archive)
+		if err != nil {
+			if stream != nil {
+				closeStream(archive, stream, err)
+			}
+			return err
+		}
+	}
+
 	for {
-		_, err = c.parseEntry(archive)
+		var offset int64
+		if c.recover {
+			offset, err = archive.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return err
+			}
+		}
+
+		var e *entry
+		e, err = c.parseEntry(archive)
+		if err == nil && !e.archiveRecord() {
+			c.entryDone(c.archiveBytes(archive, e))
+		}
+		if err != nil && err != io.EOF && c.recover {
+			err = c.recoverEntry(archive, offset, e, err)
+		}
 		if err == io.EOF {
+			err = nil
 			break
 		}
 		if err != nil {
-			return err
+			break
 		}
 	}
 
+	// The end marker and the padding after the last entry were read too
+	if err == nil && c.archiveSize > 0 {
+		c.progress.bytes = uint64(c.archiveSize)
+	}
+
+	// The permissions of the directories are set after all the files are written
+	c.stopWorkers()
+
+	if stream != nil {
+		err = closeStream(archive, stream, err)
+	}
+	if err != nil {
+		return err
+	}
+
+	if c.dryRun {
+		return nil
+	}
+
 	return c.deferredPermissions()
 
 }
@@ -2,4 +2,9 @@ module github.com/teknoraver/car
 
 go 1.21
 
-require golang.org/x/sys v0.25.0
+require (
+	github.com/klauspost/compress v1.17.11
+	github.com/ulikunitz/xz v0.5.12
+	golang.org/x/crypto v0.27.0
+	golang.org/x/sys v0.25.0
+)
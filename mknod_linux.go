@@ -0,0 +1,10 @@
+//go:build linux
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// mknodAt creates a device or a FIFO in the parent directory
+func mknodAt(parent int, name string, mode uint32, dev int) error {
+	return unix.Mknodat(parent, name, mode, dev)
+}
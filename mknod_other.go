@@ -0,0 +1,27 @@
+//go:build !linux
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+/* mknodAt creates a device or a FIFO in the parent directory. Without mknodat(), as on darwin,
+ * the node is created with the parent as working directory, which is restored after */
+func mknodAt(parent int, name string, mode uint32, dev int) error {
+	cwd, err := os.Open(".")
+	if err != nil {
+		return err
+	}
+	defer cwd.Close()
+
+	err = unix.Fchdir(parent)
+	if err != nil {
+		return err
+	}
+	defer unix.Fchdir(int(cwd.Fd()))
+
+	return unix.Mknod(name, mode, dev)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// What to do when an entry is extracted over an existing file
+const (
+	overwriteReplace = iota
+	overwriteKeepOld
+	overwriteSkipOld
+	overwriteKeepNewer
+)
+
+// How existing files are saved before being replaced
+const (
+	backupNone = iota
+	backupSimple
+	backupNumbered
+)
+
+// checkExisting applies the overwrite policy to a file in the way of the entry.
+// It returns false if the entry must not be extracted
+func (c *car) checkExisting(parent int, name string, e entry) (bool, error) {
+	if c.overwrite == overwriteReplace && c.backup == backupNone && !c.unlinkFirst {
+		return true, nil
+	}
+
+	var st unix.Stat_t
+	err := unix.Fstatat(parent, name, &st, unix.AT_SYMLINK_NOFOLLOW)
+	if err == unix.ENOENT {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	// Directories are merged, and the new permissions applied
+	isDir := st.Mode&unix.S_IFMT == unix.S_IFDIR
+	if isDir && e.Mode&unix.S_IFMT == unix.S_IFDIR {
+		return true, nil
+	}
+
+	switch c.overwrite {
+	case overwriteKeepOld:
+		return false, unix.EEXIST
+	case overwriteSkipOld:
+		if c.verbose {
+			fmt.Fprintf(os.Stderr, "skipping existing '%s'\n", e.name)
+		}
+		return false, nil
+	case overwriteKeepNewer:
+		if st.Mtim.Nano() > e.Mtime {
+			fmt.Fprintf(os.Stderr, "not replacing '%s' which is newer than the archived one\n", e.name)
+			return false, nil
+		}
+	}
+
+	if c.backup != backupNone && !isDir {
+		return true, c.backupFile(parent, name)
+	}
+
+	if c.unlinkFirst {
+		return true, c.removeExisting(parent, name)
+	}
+
+	return true, nil
+}
+
+// backupFile renames a file to name~, or to name.~N~ with the first free N for numbered backups
+func (c *car) backupFile(parent int, name string) error {
+	backup := name + "~"
+
+	if c.backup == backupNumbered {
+		var st unix.Stat_t
+		for n := 1; ; n++ {
+			backup = name + ".~" + strconv.Itoa(n) + "~"
+			err := unix.Fstatat(parent, backup, &st, unix.AT_SYMLINK_NOFOLLOW)
+			if err == unix.ENOENT {
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return unix.Renameat(parent, name, parent, backup)
+}
+
+// removeExisting removes the file in the way of an entry, directories only if empty or with --recursive-unlink
+func (c *car) removeExisting(parent int, name string) error {
+	if c.recursiveUnlink {
+		return removeAllAt(parent, name)
+	}
+	return removeAt(parent, name)
+}
+
+// replaceAt runs create, and if something is in the way removes it and runs create again
+func (c *car) replaceAt(parent int, name string, create func() error) error {
+	err := create()
+	if err != unix.EEXIST && err != unix.EISDIR {
+		return err
+	}
+
+	err = c.removeExisting(parent, name)
+	if err != nil {
+		return err
+	}
+
+	return create()
+}
+
+// removeAllAt removes a file or a directory with all its content, like os.RemoveAll(),
+// without following symlinks in the tree
+func removeAllAt(parent int, name string) error {
+	err := removeAt(parent, name)
+	if err != unix.ENOTEMPTY && err != unix.EEXIST {
+		return err
+	}
+
+	fd, err := unix.Openat(parent, name, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+
+	dir := os.NewFile(uintptr(fd), name)
+	names, err := dir.Readdirnames(-1)
+	for i := 0; err == nil && i < len(names); i++ {
+		err = removeAllAt(fd, names[i])
+	}
+	dir.Close()
+	if err != nil {
+		return err
+	}
+
+	return unix.Unlinkat(parent, name, unix.AT_REMOVEDIR)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// setError records that something failed, and can be called by the workers
+func (c *car) setError() {
+	c.mutex.Lock()
+	c.error = 1
+	c.mutex.Unlock()
+}
+
+// startWorkers starts the goroutines which write the file contents in parallel
+func (c *car) startWorkers() {
+	c.tasks = make(chan func(), c.jobs)
+	for i := 0; i < c.jobs; i++ {
+		c.workers.Add(1)
+		go func() {
+			defer c.workers.Done()
+			for task := range c.tasks {
+				task()
+			}
+		}()
+	}
+}
+
+// stopWorkers waits for the files being written, and stops the workers
+func (c *car) stopWorkers() {
+	if c.tasks != nil {
+		close(c.tasks)
+		c.workers.Wait()
+		c.tasks = nil
+	}
+}
+
+// waitPending waits for the file being written with the given name, if any
+func (c *car) waitPending(name string) {
+	c.mutex.Lock()
+	pending := c.pending[plannedName(name)]
+	c.mutex.Unlock()
+
+	if pending {
+		c.stopWorkers()
+		c.startWorkers()
+	}
+}
+
+/* writeAsync writes the data of a regular file in a worker, and then moves it in place.
+ * The parent directory fd is duplicated, as it's closed by the caller */
+func (c *car) writeAsync(archive *os.File, f *os.File, e entry, parent int, name, tmp string) error {
+	parent, err := unix.FcntlInt(uintptr(parent), unix.F_DUPFD_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+
+	key := plannedName(e.name)
+	c.mutex.Lock()
+	c.pending[key] = true
+	c.mutex.Unlock()
+
+	c.tasks <- func() {
+		err := c.finishFile(archive, f, e, parent, name, tmp)
+		f.Close()
+		unix.Close(parent)
+
+		c.mutex.Lock()
+		delete(c.pending, key)
+		c.mutex.Unlock()
+
+		if err != nil {
+			c.setError()
+			fmt.Fprintf(os.Stderr, "cannot create %s: %v\n", e.name, err)
+		}
+	}
+
+	return nil
+}
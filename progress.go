@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Minimum interval between two progress reports
+const progressInterval = time.Second
+
+// State of --progress and --checkpoint, updated after every entry
+type progress struct {
+	show  bool
+	start time.Time
+	last  time.Time
+	// Length of the last report, to clear it when the next one is shorter
+	width int
+
+	entries uint64
+	bytes   uint64
+	// Unknown when zero
+	totalEntries uint64
+	totalBytes   uint64
+}
+
+// Actions run every --checkpoint entries
+const (
+	checkpointEcho = "echo"
+	checkpointDot  = "dot"
+	checkpointExec = "exec="
+)
+
+// validCheckpointAction tells if the action is supported by --checkpoint-action
+func validCheckpointAction(action string) bool {
+	return action == checkpointEcho || action == checkpointDot ||
+		strings.HasPrefix(action, checkpointExec) && len(action) > len(checkpointExec)
+}
+
+// scanPaths counts the entries and the file data to archive, as total for --progress
+func scanPaths(paths []string) (uint64, uint64) {
+	var entries, bytes uint64
+
+	for _, dir := range paths {
+		// Errors will be reported while archiving
+		filepath.Walk(dir, func(p string, info fs.FileInfo, err error) error {
+			if err == nil {
+				entries++
+				if info.Mode().IsRegular() {
+					bytes += uint64(info.Size())
+				}
+			}
+			return nil
+		})
+	}
+
+	return entries, bytes
+}
+
+// startProgress starts measuring the throughput, with the totals if known
+func (c *car) startProgress(entries, bytes uint64) {
+	c.progress.start = time.Now()
+	c.progress.last = c.progress.start
+	c.progress.totalEntries = entries
+	c.progress.totalBytes = bytes
+}
+
+/* entryDone is called after every entry, with the bytes it took: of file data when archiving,
+ * of the archive when extracting. It runs the checkpoint actions and prints the progress */
+func (c *car) entryDone(bytes uint64) {
+	p := &c.progress
+	p.entries++
+	p.bytes += bytes
+
+	if c.checkpoint > 0 && p.entries%c.checkpoint == 0 {
+		c.runCheckpoint(p.entries / c.checkpoint)
+	}
+
+	if p.show && time.Since(p.last) >= progressInterval {
+		p.last = time.Now()
+		c.printProgress(false)
+	}
+}
+
+// archiveBytes returns the bytes of the archive taken by the entry just extracted
+func (c *car) archiveBytes(archive *os.File, e *entry) uint64 {
+	if c.seekable && c.progress.show {
+		if offset, err := archive.Seek(0, io.SeekCurrent); err == nil && uint64(offset) >= c.progress.bytes {
+			return uint64(offset) - c.progress.bytes
+		}
+	}
+	return e.payload()
+}
+
+// runCheckpoint runs the --checkpoint-action actions, "echo" if none
+func (c *car) runCheckpoint(n uint64) {
+	actions := c.checkpointActions
+	if len(actions) == 0 {
+		actions = []string{checkpointEcho}
+	}
+
+	for _, action := range actions {
+		switch {
+		case action == checkpointEcho:
+			fmt.Fprintf(os.Stderr, "car: checkpoint %d\n", n)
+		case action == checkpointDot:
+			fmt.Fprint(os.Stderr, ".")
+		case strings.HasPrefix(action, checkpointExec):
+			cmd := exec.Command("/bin/sh", "-c", action[len(checkpointExec):])
+			cmd.Env = append(os.Environ(),
+				"CAR_CHECKPOINT="+strconv.FormatUint(n, 10),
+				"CAR_ENTRIES="+strconv.FormatUint(c.progress.entries, 10),
+				"CAR_BYTES="+strconv.FormatUint(c.progress.bytes, 10))
+			// The archive could be written to stdout
+			cmd.Stdout = os.Stderr
+			cmd.Stderr = os.Stderr
+			if err := cmd.Run(); err != nil {
+				fmt.Fprintf(os.Stderr, "checkpoint action failed: %v\n", err)
+			}
+		}
+	}
+}
+
+// printProgress prints the entries and bytes done, the throughput and the ETA on a single line, ended if final
+func (c *car) printProgress(final bool) {
+	p := &c.progress
+	if p.start.IsZero() {
+		return
+	}
+
+	elapsed := time.Since(p.start).Seconds()
+	rate := float64(p.bytes) / max(elapsed, 0.001)
+
+	line := strconv.FormatUint(p.entries, 10)
+	if p.totalEntries > 0 {
+		line += "/" + strconv.FormatUint(p.totalEntries, 10)
+	}
+	line += " entries, " + strings.TrimSpace(prettySize(p.bytes))
+	if p.totalBytes > 0 {
+		line += fmt.Sprintf(" of %s (%d%%)", strings.TrimSpace(prettySize(p.totalBytes)), min(p.bytes*100/p.totalBytes, 100))
+	}
+	line += ", " + strings.TrimSpace(prettySize(uint64(rate))) + "/s"
+	if !final && p.totalBytes > p.bytes && rate > 0 {
+		eta := time.Duration(float64(p.totalBytes-p.bytes) / rate * float64(time.Second))
+		line += ", ETA " + eta.Round(time.Second).String()
+	}
+
+	padding := max(p.width-len(line), 0)
+	p.width = len(line)
+	fmt.Fprintf(os.Stderr, "\r%s%s", line, strings.Repeat(" ", padding))
+	if final {
+		fmt.Fprintln(os.Stderr)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// validEntry tells if a valid entry starts at the given offset, followed by another entry or the end of the archive
+func (c *car) validEntry(archive *os.File, offset int64) bool {
+	// A candidate found in the data of a file can contain anything, so it must not change the state of the reader
+	alignment, dataNames, magicRead := c.alignment, c.dataNames, c.magicRead
+	c.dataNames = nil
+	defer func() { c.alignment, c.dataNames, c.magicRead = alignment, dataNames, magicRead }()
+
+	_, err := archive.Seek(offset, io.SeekStart)
+	if err != nil {
+		return false
+	}
+
+	e, err := c.readEntry(archive)
+	if err == io.EOF {
+		// The end marker is valid only if followed by the padding
+		return c.onlyZeroes(archive, offset+int64(len(cowEnd)))
+	}
+	if err != nil {
+		return false
+	}
+
+	end, err := archive.Seek(int64(e.payload()), io.SeekCurrent)
+	if err != nil {
+		return false
+	}
+
+	// A truncated archive could end right after the data
+	if c.archiveSize > 0 && end == c.archiveSize {
+		return true
+	}
+
+	next := make([]byte, len(cowMagic))
+	_, err = archive.ReadAt(next, end)
+	if err != nil {
+		return false
+	}
+
+	return string(next) == cowMagic || string(next) == cowEnd
+}
+
+// onlyZeroes tells if there is nothing but zeroes from offset to the end of the archive
+func (c *car) onlyZeroes(archive *os.File, offset int64) bool {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := archive.ReadAt(buf, offset)
+		if bytes.ContainsFunc(buf[:n], func(r rune) bool { return r != 0 }) {
+			return false
+		}
+		if err == io.EOF {
+			return true
+		}
+		if err != nil {
+			return false
+		}
+		offset += int64(n)
+	}
+}
+
+/* findEntry scans the archive from offset looking for the next valid entry or the end marker.
+ * Entries aren't aligned, so every position is a candidate, but a candidate is accepted only
+ * if its header is valid and it's followed by another entry */
+func (c *car) findEntry(archive *os.File, offset int64) (int64, error) {
+	buf := make([]byte, 64*1024)
+	overlap := len(cowMagic) - 1
+
+	for {
+		n, err := archive.ReadAt(buf, offset)
+		if n <= overlap {
+			if err == nil || err == io.EOF {
+				err = io.EOF
+			}
+			return -1, err
+		}
+
+		for i := 0; i <= n-len(cowMagic); i++ {
+			magic := string(buf[i : i+len(cowMagic)])
+			if (magic == cowMagic || magic == cowEnd) && c.validEntry(archive, offset+int64(i)) {
+				return offset + int64(i), nil
+			}
+		}
+
+		if err == io.EOF {
+			return -1, err
+		}
+		if err != nil {
+			return -1, err
+		}
+		offset += int64(n - overlap)
+	}
+}
+
+/* recoverEntry is called when the entry at offset is damaged: it reports what is lost,
+ * and moves to the next valid entry. It returns io.EOF if nothing else can be recovered */
+func (c *car) recoverEntry(archive *os.File, offset int64, e *entry, perr error) error {
+	if !c.seekable {
+		return errors.New("recovery needs a seekable archive")
+	}
+
+	c.setError()
+	fmt.Fprintf(os.Stderr, "bad entry at offset %d: %v\n", offset, perr)
+	if e != nil && e.name != "" {
+		fmt.Fprintf(os.Stderr, "lost member: %s\n", e.name)
+	}
+
+	next, err := c.findEntry(archive, offset+1)
+	if err == io.EOF {
+		fmt.Fprintf(os.Stderr, "lost bytes %d-end, no more entries found\n", offset)
+		return io.EOF
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "lost bytes %d-%d\n", offset, next)
+
+	_, err = archive.Seek(next, io.SeekStart)
+
+	return err
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// cloneFile shares the extents of a range of src with dst. It's a variable so that tests can replace it
+var cloneFile = cloneRange
+
+// reflinkFailed wraps the reason of a failed reflink into reflinkError, so that it can be reported
+func reflinkFailed(err error) error {
+	return fmt.Errorf("%w: %w", reflinkError, err)
+}
+
+func reflinkToArchive(inFd *os.File, archive *os.File, size uint64) error {
+	// The archive can be non seekable (e.g. a pipe), in this case fall back to classic copy
+	offset, err := archive.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return reflinkFailed(err)
+	}
+
+	/* The data is aligned in the archive, so the whole file can be cloned, even if smaller than a block:
+	 * reflink allows a range with an unaligned length when it ends at the end of the source file.
+	 * reflink could fail for a lot of reasons (unsupported, different mountpoint, the file was
+	 * modified etc.), fallback to a copy in case of non fatal error */
+	err = cloneFile(archive, inFd, 0, size, uint64(offset))
+	if err != nil {
+		return reflinkFailed(err)
+	}
+
+	// Past this point, errors are fatal
+
+	// reflink does not move the file pointers, skip the file content
+	_, err = inFd.Seek(int64(size), io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	_, err = archive.Seek(int64(size), io.SeekCurrent)
+
+	return err
+}
+
+func reflinkFromArchive(archive *os.File, outFd *os.File, offset int64, size, alignment uint64) error {
+	/* reflink could fail for a lot of reasons (unsupported, different mountpoint etc.)
+	 * fallback to a copy in case of non fatal error */
+	err := cloneFile(outFd, archive, uint64(offset), roundUp(size, alignment), 0)
+	if err != nil {
+		return reflinkFailed(err)
+	}
+
+	// Past this point, errors are fatal
+
+	// We rounded up to the block size, truncate the file to remove the excess, if any
+	if size%alignment != 0 {
+		err = outFd.Truncate(int64(size))
+	}
+
+	return err
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+)
+
+// Set when the kernel lacks openat2(), so that the userspace resolution is used
+var openat2Unsupported atomic.Bool
+
+// Maximum number of symlinks followed while resolving a path, as the kernel does
+const maxSymlinks = 40
+
+func splitPath(path string) []string {
+	return strings.FieldsFunc(path, func(r rune) bool { return r == '/' })
+}
+
+/* openBeneathFallback resolves a directory path below dirfd one component at a time,
+ * following the symlinks by hand. Like RESOLVE_BENEATH, it fails with EXDEV if the path
+ * or any symlink in it is absolute or escapes dirfd via "..". Every component is opened
+ * with O_NOFOLLOW, so swapping it with a symlink after the check makes the open fail. */
+func openBeneathFallback(dirfd int, path string) (int, error) {
+	if strings.HasPrefix(path, "/") {
+		return -1, unix.EXDEV
+	}
+
+	root, err := unix.Openat(dirfd, ".", dirOpenFlags, 0)
+	if err != nil {
+		return -1, err
+	}
+
+	// The directories walked so far, the first one is the root
+	stack := []int{root}
+	defer func() {
+		for _, fd := range stack {
+			unix.Close(fd)
+		}
+	}()
+
+	components := splitPath(path)
+	links := 0
+
+	for len(components) > 0 {
+		comp := components[0]
+		components = components[1:]
+		top := stack[len(stack)-1]
+
+		switch comp {
+		case ".":
+			continue
+		case "..":
+			if len(stack) == 1 {
+				return -1, unix.EXDEV
+			}
+			unix.Close(top)
+			stack = stack[:len(stack)-1]
+			continue
+		}
+
+		var st unix.Stat_t
+		err := unix.Fstatat(top, comp, &st, unix.AT_SYMLINK_NOFOLLOW)
+		if err != nil {
+			return -1, err
+		}
+
+		if st.Mode&unix.S_IFMT == unix.S_IFLNK {
+			links++
+			if links > maxSymlinks {
+				return -1, unix.ELOOP
+			}
+
+			buf := make([]byte, unix.PathMax)
+			n, err := unix.Readlinkat(top, comp, buf)
+			if err != nil {
+				return -1, err
+			}
+
+			target := string(buf[:n])
+			if strings.HasPrefix(target, "/") {
+				return -1, unix.EXDEV
+			}
+
+			components = append(splitPath(target), components...)
+			continue
+		}
+
+		fd, err := unix.Openat(top, comp, dirOpenFlags|unix.O_NOFOLLOW, 0)
+		if err != nil {
+			return -1, err
+		}
+		stack = append(stack, fd)
+	}
+
+	// Keep the last directory open, the deferred function closes the others
+	fd := stack[len(stack)-1]
+	stack = stack[:len(stack)-1]
+
+	return fd, nil
+}
@@ -0,0 +1,35 @@
+//go:build linux
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// O_PATH allows to walk directories without read permission
+const dirOpenFlags = unix.O_PATH | unix.O_DIRECTORY | unix.O_CLOEXEC
+
+// openBeneath opens a directory which must be below dirfd, even after resolving the symlinks
+func openBeneath(dirfd int, path string) (int, error) {
+	if !openat2Unsupported.Load() {
+		how := unix.OpenHow{
+			Flags:   dirOpenFlags,
+			Resolve: unix.RESOLVE_BENEATH | unix.RESOLVE_NO_MAGICLINKS,
+		}
+
+		for {
+			fd, err := unix.Openat2(dirfd, path, &how)
+			switch err {
+			// A concurrent rename happened during the resolution, retry
+			case unix.EAGAIN, unix.EINTR:
+				continue
+			// Kernels older than 5.6, or seccomp filters which don't know the syscall
+			case unix.ENOSYS, unix.EPERM:
+				openat2Unsupported.Store(true)
+			default:
+				return fd, err
+			}
+			break
+		}
+	}
+
+	return openBeneathFallback(dirfd, path)
+}
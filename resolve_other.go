@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import "golang.org/x/sys/unix"
+
+const dirOpenFlags = unix.O_RDONLY | unix.O_DIRECTORY | unix.O_CLOEXEC
+
+// openBeneath opens a directory which must be below dirfd, even after resolving the symlinks
+func openBeneath(dirfd int, path string) (int, error) {
+	return openBeneathFallback(dirfd, path)
+}
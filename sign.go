@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+func readPem(file string) ([]byte, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: not a PEM file", file)
+	}
+
+	return block.Bytes, nil
+}
+
+// loadSigningKey reads an Ed25519 private key in PKCS #8 PEM format,
+// as generated by `openssl genpkey -algorithm ed25519`
+func loadSigningKey(file string) (ed25519.PrivateKey, error) {
+	der, err := readPem(file)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+
+	if key, ok := key.(ed25519.PrivateKey); ok {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("%s: not an Ed25519 key", file)
+}
+
+// loadVerifyKey reads an Ed25519 public key in PKIX PEM format,
+// as generated by `openssl pkey -pubout`
+func loadVerifyKey(file string) (ed25519.PublicKey, error) {
+	der, err := readPem(file)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+
+	if key, ok := key.(ed25519.PublicKey); ok {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("%s: not an Ed25519 key", file)
+}
+
+// archiveDigest hashes the archive content between two offsets
+func archiveDigest(archive *os.File, start, end int64) ([]byte, error) {
+	h := sha512.New()
+
+	_, err := io.Copy(h, io.NewSectionReader(archive, start, end-start))
+	if err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
+
+// writeSignature signs everything written since start, and appends the signature in a record without name
+func (c *car) writeSignature(out *archiveWriter, start int64) error {
+	digest, err := archiveDigest(out.file, start, out.offset)
+	if err != nil {
+		return fmt.Errorf("can't read back the archive to sign it: %w", err)
+	}
+
+	_, err = out.Write([]byte(cowMagic))
+	if err != nil {
+		return err
+	}
+
+	err = c.writeTag(tagSignature, ed25519.SignatureSize, out, ed25519.Sign(c.signKey, digest))
+	if err != nil {
+		return err
+	}
+
+	return c.writeTag(tagData, 0, out, nil)
+}
+
+/* verifySignature reads the whole archive looking for the signature, which must be the last record,
+ * and checks it against the content which precedes it. The archive is then rewound, so that nothing
+ * is extracted from a tampered archive */
+func (c *car) verifySignature(archive *os.File) error {
+	if !c.seekable {
+		return errors.New("signature verification needs a seekable archive")
+	}
+
+	start, err := archive.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	var signature []byte
+	var end int64
+
+	for {
+		pos, err := archive.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+
+		e, err := c.readEntry(archive)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if signature != nil {
+			return errors.New("bad signature: entries after the signature")
+		}
+
+		if e.signature != nil {
+			signature = e.signature
+			end = pos
+		}
+
+		err = c.safeRSeek(archive, int64(e.payload()))
+		if err != nil {
+			return err
+		}
+	}
+
+	if signature == nil {
+		return errors.New("archive is not signed")
+	}
+
+	digest, err := archiveDigest(archive, start, end)
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(c.verifyKey, digest, signature) {
+		return errors.New("bad signature: the archive was tampered or signed with another key")
+	}
+
+	_, err = archive.Seek(start, io.SeekStart)
+
+	return err
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// fsFree returns the free space of a filesystem. It's a variable so that tests can fill it
+var fsFree = freeSpace
+
+/* extractedSize adds up the size of the regular files in the archive, once decoded,
+ * and the size of the ones which are always copied, as their data can't be reflinked */
+func (c *car) extractedSize(archive *os.File) (uint64, uint64, error) {
+	start, err := archive.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer archive.Seek(start, io.SeekStart)
+
+	var size, copied uint64
+	for {
+		e, err := c.readEntry(archive)
+		if err == io.EOF {
+			return size, copied, nil
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+
+		// Deduplicated entries are counted too, as they are copied if not reflinked
+		if e.Mode&unix.S_IFMT == unix.S_IFREG {
+			size += e.size
+			if e.encoding != encodingNone || e.nonce != nil || c.alignment == 1 {
+				copied += e.size
+			}
+		}
+
+		err = c.safeRSeek(archive, int64(e.payload()))
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+}
+
+// canReflink tells if the data of the archive can be reflinked into the destination, by trying with its first block
+func (c *car) canReflink(archive *os.File) bool {
+	probe, err := os.CreateTemp(c.destDir, ".car-probe")
+	if err != nil {
+		return false
+	}
+	os.Remove(probe.Name())
+	defer probe.Close()
+
+	return cloneFile(probe, archive, 0, c.alignment, 0) == nil
+}
+
+/* checkSpace fails before extracting anything if the destination has not room for all the files.
+ * When the data can be reflinked it takes no space, so if a probe reflink works only the files
+ * which are copied anyway, being compressed, encrypted or not aligned, are counted */
+func (c *car) checkSpace(archive *os.File) error {
+	if c.archiveSize == 0 {
+		return nil
+	}
+
+	free, err := fsFree(c.destFd)
+	if err != nil {
+		// Nothing to compare with
+		return nil
+	}
+
+	// Errors in the archive are reported while extracting
+	needed, copied, err := c.extractedSize(archive)
+	if err != nil || free >= needed {
+		return nil
+	}
+
+	if !c.noReflink && c.canReflink(archive) {
+		needed = copied
+		if free >= needed {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("not enough space in %s: %s needed, %s available", c.destDir,
+		strings.TrimSpace(prettySize(needed)), strings.TrimSpace(prettySize(free)))
+}
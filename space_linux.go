@@ -0,0 +1,35 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// allocate reserves the space for the data which is going to be copied, to avoid fragmenting it
+// and to fail before writing it if the filesystem is full. Filesystems without fallocate() are fine,
+// and so are outputs which aren't regular files, like /dev/null
+func allocate(f *os.File, offset, size int64) error {
+	var st unix.Stat_t
+	if err := unix.Fstat(int(f.Fd()), &st); err != nil || st.Mode&unix.S_IFMT != unix.S_IFREG {
+		return nil
+	}
+
+	err := unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_KEEP_SIZE, offset, size)
+	if err == unix.EOPNOTSUPP || err == unix.ENOSYS {
+		return nil
+	}
+	return err
+}
+
+// freeSpace returns the space available to unprivileged users in the filesystem of the file descriptor
+func freeSpace(fd int) (uint64, error) {
+	var st unix.Statfs_t
+	err := unix.Fstatfs(fd, &st)
+	if err != nil {
+		return 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), nil
+}
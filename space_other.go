@@ -0,0 +1,17 @@
+//go:build !linux
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+func allocate(*os.File, int64, int64) error {
+	return nil
+}
+
+func freeSpace(int) (uint64, error) {
+	return 0, unix.EOPNOTSUPP
+}
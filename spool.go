@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io"
+	"os"
+)
+
+/* spoolArchive saves a streamed archive into a file, which is returned ready to be extracted.
+ * The data keeps the alignment it has in the stream, so once in a file on the destination
+ * filesystem it can be reflinked into the extracted files, instead of being copied again.
+ * Without a name the spool is a temporary file in the destination directory */
+func (c *car) spoolArchive(archive *os.File, stream <-chan error) (*os.File, error) {
+	var spool *os.File
+	var err error
+	if c.spoolFile != "" {
+		spool, err = os.OpenFile(c.spoolFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	} else {
+		spool, err = os.CreateTemp(c.destDir, ".car-spool")
+		if err == nil {
+			os.Remove(spool.Name())
+		}
+	}
+	if err != nil {
+		if stream != nil {
+			closeStream(archive, stream, err)
+		}
+		return nil, err
+	}
+
+	// Put back the magic read to detect the compression, to keep the offsets of the data
+	if c.magicRead {
+		_, err = spool.WriteString(cowMagic)
+		c.magicRead = false
+	}
+
+	// The copy is done in kernel with splice() when possible
+	if err == nil {
+		_, err = io.Copy(spool, archive)
+	}
+	if stream != nil {
+		err = closeStream(archive, stream, err)
+	}
+	if err == nil {
+		_, err = spool.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		spool.Close()
+		return nil, err
+	}
+
+	return spool, nil
+}
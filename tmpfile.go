@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+)
+
+// Set when the filesystem doesn't support O_TMPFILE, to avoid trying it for every file
+var tmpfileUnsupported atomic.Bool
+
+// tempName returns a random hidden name for a file being extracted
+func tempName() string {
+	buf := make([]byte, 6)
+	rand.Read(buf)
+	return ".car" + hex.EncodeToString(buf)
+}
+
+/* createTemp creates the file which will replace name once complete. Where supported it has no name,
+ * so nothing is left behind on a crash, otherwise it has a hidden name which is returned as well */
+func createTemp(parent int, name string, mode uint32) (*os.File, string, error) {
+	if !tmpfileUnsupported.Load() {
+		fd, err := openTmpfile(parent, mode)
+		if err == nil {
+			return os.NewFile(uintptr(fd), name), "", nil
+		}
+		if err != unix.EOPNOTSUPP && err != unix.EISDIR && err != unix.EINVAL {
+			return nil, "", err
+		}
+		tmpfileUnsupported.Store(true)
+	}
+
+	for {
+		tmp := tempName()
+		fd, err := unix.Openat(parent, tmp, unix.O_WRONLY|unix.O_CREAT|unix.O_EXCL|unix.O_NOFOLLOW|unix.O_CLOEXEC, mode)
+		if err == nil {
+			return os.NewFile(uintptr(fd), name), tmp, nil
+		}
+		if err != unix.EEXIST {
+			return nil, "", err
+		}
+	}
+}
+
+// linkTemp gives a hidden name to a file created without name by createTemp
+func linkTemp(f *os.File, parent int) (string, error) {
+	for {
+		tmp := tempName()
+		err := linkTmpfile(int(f.Fd()), parent, tmp)
+		if err == nil {
+			return tmp, nil
+		}
+		if err != unix.EEXIST {
+			return "", err
+		}
+	}
+}
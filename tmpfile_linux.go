@@ -0,0 +1,24 @@
+//go:build linux
+
+package main
+
+import (
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// openTmpfile creates a file without name in the directory, which is invisible until linked
+func openTmpfile(parent int, mode uint32) (int, error) {
+	return unix.Openat(parent, ".", unix.O_TMPFILE|unix.O_WRONLY|unix.O_CLOEXEC, mode)
+}
+
+// linkTmpfile gives a name to a file created by openTmpfile
+func linkTmpfile(fd int, parent int, name string) error {
+	err := unix.Linkat(unix.AT_FDCWD, "/proc/self/fd/"+strconv.Itoa(fd), parent, name, unix.AT_SYMLINK_FOLLOW)
+	if err == unix.ENOENT {
+		// /proc is not mounted, this needs CAP_DAC_READ_SEARCH instead
+		err = unix.Linkat(fd, "", parent, name, unix.AT_EMPTY_PATH)
+	}
+	return err
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import "golang.org/x/sys/unix"
+
+func openTmpfile(int, uint32) (int, error) {
+	return -1, unix.EOPNOTSUPP
+}
+
+func linkTmpfile(int, int, string) error {
+	return unix.EOPNOTSUPP
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// countData adds the size of a file content to the counter of the method used to store it
+func (c *car) countData(method string, size uint64) {
+	if method == methodReflink {
+		c.reflinked.Add(size)
+	} else {
+		c.copied.Add(size)
+	}
+}
+
+// reflinkRequired is the error returned with --require-reflink when some data can't be shared
+func reflinkRequired(err error) error {
+	var errno unix.Errno
+	if errors.As(err, &errno) {
+		return fmt.Errorf("reflink failed: %v (%s)", errno, unix.ErrnoName(errno))
+	}
+	return fmt.Errorf("reflink failed: %v", err)
+}
+
+// printTotals prints how many bytes were shared with reflink, copied, and used by the alignment padding
+func (c *car) printTotals() {
+	for _, t := range []struct {
+		what  string
+		bytes uint64
+	}{
+		{"reflinked", c.reflinked.Load()},
+		{"copied", c.copied.Load()},
+		{"of padding", c.padded.Load()},
+	} {
+		if t.bytes < 1024 {
+			fmt.Fprintf(os.Stderr, "Total bytes %s: %d\n", t.what, t.bytes)
+		} else {
+			fmt.Fprintf(os.Stderr, "Total bytes %s: %d (%s)\n", t.what, t.bytes, strings.TrimSpace(prettySize(t.bytes)))
+		}
+	}
+}
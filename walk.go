@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// A file found by the parallel walker, ready when done is closed
+type walkNode struct {
+	path   string
+	info   fs.FileInfo
+	err    error
+	names  []string
+	dirErr error
+	done   chan struct{}
+}
+
+/* walkParallel visits the tree like filepath.Walk, in the same order, but stats the files and reads
+ * the directories with up to c.jobs goroutines. The entries of a directory are looked up when the
+ * directory is reached, and only a few at a time ahead of the one being visited, so that the memory
+ * and the goroutines used don't depend on the size of the tree */
+func (c *car) walkParallel(root string, fn filepath.WalkFunc) error {
+	sem := make(chan struct{}, c.jobs)
+	window := 2 * c.jobs
+
+	lookup := func(path string) *walkNode {
+		n := &walkNode{
+			path: path,
+			done: make(chan struct{}),
+		}
+
+		go func() {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			defer close(n.done)
+
+			n.info, n.err = os.Lstat(path)
+			if n.err != nil || !n.info.IsDir() {
+				return
+			}
+
+			dir, err := os.Open(path)
+			if err != nil {
+				n.dirErr = err
+				return
+			}
+			names, err := dir.Readdirnames(-1)
+			dir.Close()
+			if err != nil {
+				n.dirErr = err
+				return
+			}
+			slices.Sort(names)
+			n.names = names
+		}()
+
+		return n
+	}
+
+	var visit func(n *walkNode) error
+	visit = func(n *walkNode) error {
+		<-n.done
+
+		if n.err != nil {
+			return fn(n.path, nil, n.err)
+		}
+
+		// Like filepath.Walk, a directory which can't be read is passed with the error
+		err := fn(n.path, n.info, n.dirErr)
+		if err != nil || n.dirErr != nil || !n.info.IsDir() {
+			return err
+		}
+
+		children := make([]*walkNode, len(n.names))
+		started := 0
+		for i := range children {
+			for ; started < len(children) && started < i+window; started++ {
+				children[started] = lookup(filepath.Join(n.path, n.names[started]))
+			}
+
+			err = visit(children[i])
+			if err != nil {
+				// Let the pending lookups finish
+				for _, child := range children[i+1 : started] {
+					<-child.done
+				}
+				return err
+			}
+			children[i] = nil
+		}
+
+		return nil
+	}
+
+	return visit(lookup(root))
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io"
+	"os"
+)
+
+/* archiveWriter counts the bytes written to the archive, so that the data can be aligned
+ * also when the output is not seekable, e.g. a pipe to ssh: the padding is then written as
+ * zeroes, and the archive can be reflinked once saved into a file on the other side */
+type archiveWriter struct {
+	file     *os.File
+	offset   int64
+	seekable bool
+}
+
+func newArchiveWriter(file *os.File) *archiveWriter {
+	w := &archiveWriter{
+		file: file,
+	}
+
+	offset, err := file.Seek(0, io.SeekCurrent)
+	if err == nil {
+		w.offset = offset
+		w.seekable = true
+	}
+
+	return w
+}
+
+func (w *archiveWriter) Write(p []byte) (int, error) {
+	n, err := w.file.Write(p)
+	w.offset += int64(n)
+
+	return n, err
+}
+
+// ReadFrom lets io.Copy use the optimizations of os.File, like copy_file_range()
+func (w *archiveWriter) ReadFrom(r io.Reader) (int64, error) {
+	n, err := w.file.ReadFrom(r)
+	w.offset += n
+
+	return n, err
+}
+
+// advance accounts for the data written directly into the file, e.g. by reflink
+func (w *archiveWriter) advance(size int64) {
+	w.offset += size
+}
+
+// skip moves forward leaving a hole, or writes zeroes if the archive is not seekable
+func (w *archiveWriter) skip(size int64) error {
+	if w.seekable {
+		_, err := w.file.Seek(size, io.SeekCurrent)
+		if err == nil {
+			w.offset += size
+		}
+		return err
+	}
+
+	for size > 0 {
+		n := min(size, int64(len(zeroes)))
+		_, err := w.Write(zeroes[:n])
+		if err != nil {
+			return err
+		}
+		size -= n
+	}
+
+	return nil
+}